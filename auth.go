@@ -0,0 +1,277 @@
+package memongo
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The name of the admin user memongo creates when Options.Auth is true
+const authUsername = "memongo"
+
+// The database SCRAM users are created in
+const authSource = "admin"
+
+// The database x509 users are created in
+const x509AuthSource = "$external"
+
+// The number of random bytes in a generated password. The password is
+// hex-encoded, so it's twice as many characters.
+const authPasswordBytes = 16
+
+// The name of the keyfile replica set members authenticate to each other
+// with, in the data directory
+const keyFileName = "keyfile"
+
+// Role is a MongoDB role to grant a user, such as {Role: "readWrite", DB:
+// "mydb"}
+type Role struct {
+	Role string
+	DB   string
+}
+
+func rolesToBSON(roles []Role) bson.A {
+	a := bson.A{}
+	for _, role := range roles {
+		a = append(a, bson.D{{Key: "role", Value: role.Role}, {Key: "db", Value: role.DB}})
+	}
+
+	return a
+}
+
+// generatePassword returns a random password that's safe to put in a URI
+// without escaping
+func generatePassword() (string, error) {
+	b := make([]byte, authPasswordBytes)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("error generating a password: %s", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// writeKeyFile writes a random keyfile into dir, and returns its path.
+// mongod requires one when authorization is enabled on a replica set, even a
+// single-node one. The key is hex, which is a subset of the base64
+// characters mongod allows, and mongod refuses keyfiles that other users can
+// read.
+func writeKeyFile(dir string) (string, error) {
+	key, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+
+	keyFile := path.Join(dir, keyFileName)
+
+	err = ioutil.WriteFile(keyFile, []byte(key), 0600)
+	if err != nil {
+		return "", fmt.Errorf("error writing keyfile: %s", err)
+	}
+
+	return keyFile, nil
+}
+
+// authSource returns the database the admin user authenticates against
+func (s *Server) authSource() string {
+	if s.opts.AuthMechanism == AuthMechanismX509 {
+		return x509AuthSource
+	}
+
+	return authSource
+}
+
+// createAdminUser creates a root user. mongod must be running with --auth and
+// have no users yet, so the localhost exception lets us create the first user
+// without authenticating. Once the user exists, all of our connections
+// authenticate as it.
+//
+// For SCRAM, the user gets a random password. For x509, the user is the
+// subject of the server's generated client certificate.
+func (s *Server) createAdminUser(ctx context.Context) error {
+	adminRoles := []Role{{Role: "root", DB: "admin"}}
+
+	if s.opts.AuthMechanism == AuthMechanismX509 {
+		subject := s.tls.clientCert.Subject
+
+		err := s.createX509User(ctx, subject, adminRoles)
+		if err != nil {
+			return fmt.Errorf("error creating admin user: %s", err)
+		}
+
+		s.setCredentials(subject, "")
+		return nil
+	}
+
+	// Keep the password when the user is recreated after a restart
+	_, password := s.credentials()
+	if password == "" {
+		var err error
+		password, err = generatePassword()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.createSCRAMUser(ctx, authSource, authUsername, password, adminRoles)
+	if err != nil {
+		return fmt.Errorf("error creating admin user: %s", err)
+	}
+
+	s.setCredentials(authUsername, password)
+
+	return nil
+}
+
+// createSCRAMUser creates a user with a password in the given database
+func (s *Server) createSCRAMUser(ctx context.Context, db string, username string, password string, roles []Role) error {
+	command := bson.D{
+		{Key: "createUser", Value: username},
+		{Key: "pwd", Value: password},
+		{Key: "roles", Value: rolesToBSON(roles)},
+	}
+
+	// Before 4.0, SCRAM-SHA-1 was the only mechanism, and createUser didn't
+	// accept a list of them
+	if s.opts.MongoVersion != "" && mongoVersionAtLeast(s.opts.MongoVersion, 4, 0) {
+		command = append(command, bson.E{Key: "mechanisms", Value: bson.A{s.opts.AuthMechanism}})
+	}
+
+	return s.runCommand(ctx, db, command, nil)
+}
+
+// createX509User creates a user on $external for a certificate subject
+func (s *Server) createX509User(ctx context.Context, subject string, roles []Role) error {
+	return s.runCommand(ctx, x509AuthSource, bson.D{
+		{Key: "createUser", Value: subject},
+		{Key: "roles", Value: rolesToBSON(roles)},
+	}, nil)
+}
+
+// CreateX509User issues a client certificate with the given subject, signed
+// by the server's generated CA, and creates a user on the $external database
+// for it with the given roles. The server must have been started with
+// Options.TLS, and is usually started with AuthMechanismX509 so that the
+// user is enforced.
+//
+// Connect as the user with ClientTLSConfig(cert) and a URI with
+// authMechanism=MONGODB-X509, such as URI().
+func (s *Server) CreateX509User(ctx context.Context, subject pkix.Name, roles ...Role) (*ClientCertificate, error) {
+	if s.tls == nil {
+		return nil, errors.New("the server was not started with TLS")
+	}
+
+	cert, err := s.tls.issueClientCertificate(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.createX509User(ctx, cert.Subject, roles)
+	if err != nil {
+		return nil, fmt.Errorf("error creating x509 user %s: %s", cert.Subject, err)
+	}
+
+	return cert, nil
+}
+
+// ScopedUser is a user created by Server.NewScopedUser, with access to a
+// single database
+type ScopedUser struct {
+	Username string
+	Password string
+
+	// The database the user can access, which is also the database the user
+	// authenticates against
+	Database string
+
+	// A mongodb:// URI that authenticates as the user, with Database as the
+	// default database
+	URI string
+}
+
+// The roles NewScopedUser grants if none are given
+var defaultScopedUserRoles = []string{"readWrite"}
+
+// NewScopedUser creates a user with a random name and password that has the
+// given roles (readWrite by default) on dbName, and no access to any other
+// database. The server must have been started with Options.Auth and a SCRAM
+// mechanism; for x509, use CreateX509User.
+//
+// This is handy for checking that code doesn't touch databases other than
+// its own, and that it handles Unauthorized errors when it lacks a role:
+//
+//	user, err := server.NewScopedUser(ctx, memongo.RandomDatabase(), "read")
+func (s *Server) NewScopedUser(ctx context.Context, dbName string, roles ...string) (*ScopedUser, error) {
+	if !s.opts.Auth || s.opts.AuthMechanism == AuthMechanismX509 {
+		return nil, errors.New("the server was not started with SCRAM auth")
+	}
+
+	if len(roles) == 0 {
+		roles = defaultScopedUserRoles
+	}
+
+	dbRoles := make([]Role, len(roles))
+	for i, role := range roles {
+		dbRoles[i] = Role{Role: role, DB: dbName}
+	}
+
+	username := "user_" + RandomDatabase()
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.createSCRAMUser(ctx, dbName, username, password, dbRoles)
+	if err != nil {
+		return nil, fmt.Errorf("error creating user on %s: %s", dbName, err)
+	}
+
+	return &ScopedUser{
+		Username: username,
+		Password: password,
+		Database: dbName,
+		URI:      s.buildUserURI(s.host(), dbName, username, password, dbName),
+	}, nil
+}
+
+// Username returns the name of the admin user if the server was started with
+// Options.Auth, or "" otherwise. With AuthMechanismX509, this is the subject
+// of the generated client certificate.
+func (s *Server) Username() string {
+	username, _ := s.credentials()
+	return username
+}
+
+// Password returns the password of the admin user if the server was started
+// with Options.Auth, or "" otherwise. With AuthMechanismX509, there is no
+// password.
+func (s *Server) Password() string {
+	_, password := s.credentials()
+	return password
+}
+
+// credentials returns the admin user's username and password, which are ""
+// until the user has been created
+func (s *Server) credentials() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.username, s.password
+}
+
+func (s *Server) setCredentials(username string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.username = username
+	s.password = password
+}
@@ -0,0 +1,89 @@
+package memongo
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// bindArgs returns the mongod arguments for the addresses and socket to
+// listen on. Passing a path to --bind_ip makes mongod listen on a socket at
+// that path. mongod also creates a socket named after its port, which we put
+// in the data directory rather than /tmp so it doesn't clash with other
+// servers.
+func (s *Server) bindArgs() []string {
+	var bindIPs []string
+	if !s.opts.DisableTCP {
+		if s.opts.BindIP != "" {
+			bindIPs = append(bindIPs, s.opts.BindIP)
+		} else if s.opts.UnixSocket {
+			// Passing a socket to --bind_ip replaces the default of
+			// localhost, so we have to add it back
+			bindIPs = append(bindIPs, "127.0.0.1")
+		}
+	}
+	if s.opts.UnixSocket {
+		bindIPs = append(bindIPs, s.socketPath())
+	}
+
+	var args []string
+	if len(bindIPs) > 0 {
+		args = append(args, "--bind_ip", strings.Join(bindIPs, ","))
+	}
+	if s.opts.UnixSocket {
+		args = append(args, "--unixSocketPrefix", s.dbDir)
+	}
+	if s.opts.IPv6 {
+		args = append(args, "--ipv6")
+	}
+
+	return args
+}
+
+// connectableHost picks an address to connect to from the addresses mongod
+// is listening on, or returns "" if there are none. If mongod is listening on
+// all interfaces, we connect over loopback.
+func connectableHost(addresses []string) string {
+	for _, address := range addresses {
+		address = strings.TrimSpace(address)
+
+		switch address {
+		case "":
+			continue
+		case "0.0.0.0":
+			return "127.0.0.1"
+		case "::":
+			return "::1"
+		default:
+			return address
+		}
+	}
+
+	return ""
+}
+
+// tcpHost returns the host to connect to over TCP: the address mongod
+// reported it's listening on, or the first address in Options.BindIP, or
+// localhost.
+func (s *Server) tcpHost() string {
+	if boundHost, _ := s.address(); boundHost != "" {
+		return boundHost
+	}
+
+	if host := connectableHost(strings.Split(s.opts.BindIP, ",")); host != "" {
+		return host
+	}
+
+	return "localhost"
+}
+
+// host returns the host to connect to: the socket if TCP is disabled, or the
+// server's address and port otherwise
+func (s *Server) host() string {
+	if s.opts.DisableTCP {
+		return s.socketHost()
+	}
+
+	_, port := s.address()
+	return net.JoinHostPort(s.tcpHost(), strconv.Itoa(port))
+}
@@ -0,0 +1,89 @@
+package memongo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBindArgs(t *testing.T) {
+	tests := map[string]struct {
+		opts Options
+
+		expectedArgs []string
+	}{
+		"default": {
+			opts:         Options{},
+			expectedArgs: nil,
+		},
+		"bind IP": {
+			opts:         Options{BindIP: "127.0.0.1,::1", IPv6: true},
+			expectedArgs: []string{"--bind_ip", "127.0.0.1,::1", "--ipv6"},
+		},
+		"socket": {
+			opts:         Options{UnixSocket: true},
+			expectedArgs: []string{"--bind_ip", "127.0.0.1,/tmp/1234/mongodb.sock", "--unixSocketPrefix", "/tmp/1234"},
+		},
+		"socket and bind IP": {
+			opts:         Options{UnixSocket: true, BindIP: "::1", IPv6: true},
+			expectedArgs: []string{"--bind_ip", "::1,/tmp/1234/mongodb.sock", "--unixSocketPrefix", "/tmp/1234", "--ipv6"},
+		},
+		"socket only": {
+			opts:         Options{UnixSocket: true, DisableTCP: true},
+			expectedArgs: []string{"--bind_ip", "/tmp/1234/mongodb.sock", "--unixSocketPrefix", "/tmp/1234"},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			opts := test.opts
+			server := &Server{opts: &opts, dbDir: "/tmp/1234"}
+
+			assert.Equal(t, test.expectedArgs, server.bindArgs())
+		})
+	}
+}
+
+func TestConnectableHost(t *testing.T) {
+	assert.Equal(t, "", connectableHost(nil))
+	assert.Equal(t, "", connectableHost([]string{""}))
+	assert.Equal(t, "127.0.0.1", connectableHost([]string{"127.0.0.1", "::1"}))
+	assert.Equal(t, "::1", connectableHost([]string{" ::1"}))
+	assert.Equal(t, "127.0.0.1", connectableHost([]string{"0.0.0.0"}))
+	assert.Equal(t, "::1", connectableHost([]string{"::"}))
+}
+
+func TestHost(t *testing.T) {
+	tests := map[string]struct {
+		server *Server
+
+		expectedHost string
+	}{
+		"default": {
+			server:       &Server{opts: &Options{}, port: 27100},
+			expectedHost: "localhost:27100",
+		},
+		"bound address": {
+			server:       &Server{opts: &Options{}, port: 27100, boundHost: "127.0.0.1"},
+			expectedHost: "127.0.0.1:27100",
+		},
+		"bound IPv6 address": {
+			server:       &Server{opts: &Options{BindIP: "::1"}, port: 27100, boundHost: "::1"},
+			expectedHost: "[::1]:27100",
+		},
+		"bind IP not reported": {
+			server:       &Server{opts: &Options{BindIP: "::1,127.0.0.1"}, port: 27100},
+			expectedHost: "[::1]:27100",
+		},
+		"socket only": {
+			server:       &Server{opts: &Options{UnixSocket: true, DisableTCP: true}, dbDir: "/tmp/1234", port: disabledTCPPort},
+			expectedHost: "%2Ftmp%2F1234%2Fmongodb.sock",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expectedHost, test.server.host())
+		})
+	}
+}
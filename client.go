@@ -0,0 +1,74 @@
+package memongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// connect opens a direct connection to this server (bypassing replica set
+// discovery), for running administrative commands. If the admin user has
+// been created, the connection authenticates as it. The caller is
+// responsible for disconnecting the returned client.
+func (s *Server) connect(ctx context.Context) (*mongo.Client, error) {
+	clientOpts := options.Client().
+		ApplyURI("mongodb://" + s.host()).
+		SetDirect(true)
+	if username, password := s.credentials(); username != "" {
+		clientOpts.SetAuth(options.Credential{
+			AuthMechanism: s.opts.AuthMechanism,
+			AuthSource:    s.authSource(),
+			Username:      username,
+			Password:      password,
+		})
+	}
+	if s.tls != nil {
+		clientOpts.SetTLSConfig(s.TLSConfig())
+	}
+
+	// The driver doesn't give up on selecting a server when ctx is done, so
+	// make sure it doesn't wait any longer than ctx allows
+	if deadline, ok := ctx.Deadline(); ok {
+		clientOpts.SetServerSelectionTimeout(time.Until(deadline))
+	}
+
+	client, err := mongo.NewClient(clientOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// runAdminCommand runs a command against this server's admin database and
+// decodes the result into result (which may be nil).
+func (s *Server) runAdminCommand(ctx context.Context, command bson.D, result interface{}) error {
+	return s.runCommand(ctx, "admin", command, result)
+}
+
+// runCommand runs a command against the given database and decodes the
+// result into result (which may be nil).
+func (s *Server) runCommand(ctx context.Context, db string, command bson.D, result interface{}) error {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = client.Disconnect(context.Background())
+	}()
+
+	res := client.Database(db).RunCommand(ctx, command)
+	if result == nil {
+		return res.Err()
+	}
+
+	return res.Decode(result)
+}
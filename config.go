@@ -1,12 +1,18 @@
 package memongo
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -16,12 +22,87 @@ import (
 	"github.com/benweissmann/memongo/mongobin"
 )
 
+// The storage engines that can be passed as Options.StorageEngine
+const (
+	StorageEngineEphemeralForTest = "ephemeralForTest"
+	StorageEngineWiredTiger       = "wiredTiger"
+	StorageEngineInMemory         = "inMemory"
+)
+
+// The mechanisms that can be passed as Options.AuthMechanism
+const (
+	AuthMechanismSCRAMSHA1   = "SCRAM-SHA-1"
+	AuthMechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	AuthMechanismX509        = "MONGODB-X509"
+)
+
+// A RAM-backed filesystem that's available on most Linux systems. When we run
+// with wiredTiger, we put the data directory here if we can.
+var ramDiskPath = "/dev/shm"
+
+// PortRange is an inclusive range of port numbers
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// isSet returns true if the range has been configured
+func (r PortRange) isSet() bool {
+	return r.Min != 0 || r.Max != 0
+}
+
+func (r PortRange) validate() error {
+	if r.Min <= 0 || r.Max > 65535 || r.Min > r.Max {
+		return fmt.Errorf("invalid port range %d-%d", r.Min, r.Max)
+	}
+
+	return nil
+}
+
+// parsePortRange parses a port range in the form "min-max"
+func parsePortRange(str string) (PortRange, error) {
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return PortRange{}, fmt.Errorf("port range %q is not in the form min-max", str)
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("could not parse port range %q: %s", str, err)
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("could not parse port range %q: %s", str, err)
+	}
+
+	r := PortRange{Min: min, Max: max}
+	return r, r.validate()
+}
+
+const defaultMaxPortRetries = 3
+
+// How many random ports to try from a PortRange before giving up
+const portRangeAttempts = 100
+
 // Options is the configuration options for a launched MongoDB binary
 type Options struct {
 	// Port to run MongoDB on. If this is not specified, a random (OS-assigned)
 	// port will be used
 	Port int
 
+	// If given (and Port isn't), memongo picks a free port from this range
+	// rather than letting the OS choose one. This is useful on CI hosts with
+	// firewall constraints. Can also be set with the MEMONGO_MONGOD_PORT_RANGE
+	// environment variable, as "min-max".
+	PortRange PortRange
+
+	// If memongo picked mongod's port and mongod fails to start because the
+	// port is in use (another process grabbed it first), memongo picks a new
+	// port and tries again, up to this many times. Defaults to 3. Set to -1
+	// to never retry.
+	MaxPortRetries int
+
 	// Path to the cache for downloaded mongod binaries. Defaults to the
 	// system cache location.
 	CachePath string
@@ -37,6 +118,11 @@ type Options struct {
 	// If given, this binary will be run instead of downloading a mongod binary
 	MongodBin string
 
+	// If given, this binary will be used as the mongos router for sharded
+	// clusters. If MongodBin is given but MongosBin isn't, memongo looks for
+	// a mongos binary next to MongodBin.
+	MongosBin string
+
 	// Logger for printing messages. Defaults to printing to stdout.
 	Logger *log.Logger
 
@@ -46,12 +132,125 @@ type Options struct {
 	// How long to wait for mongod to start up and report a port number. Does
 	// not include download time, only startup time. Defaults to 10 seconds.
 	StartupTimeout time.Duration
+
+	// The storage engine to run mongod with: StorageEngineEphemeralForTest,
+	// StorageEngineWiredTiger, or StorageEngineInMemory (which is only
+	// available in MongoDB Enterprise).
+	//
+	// Defaults to ephemeralForTest for standalone servers on MongoDB versions
+	// that have it. MongoDB 7.0 removed ephemeralForTest, so on 7.0 and later,
+	// and for replica sets, the default is wiredTiger with a small cache and
+	// its data directory in /dev/shm (when available), to keep it in memory.
+	StorageEngine string
+
+	// If ReplicaSet is true, mongod is started as a single-node replica set,
+	// which is initiated before StartWithOptions returns. This is needed to
+	// test transactions, change streams, and causally consistent sessions.
+	ReplicaSet bool
+
+	// The name of the replica set when ReplicaSet is true. Defaults to "rs0".
+	ReplicaSetName string
+
+	// If Auth is true, mongod is started with --auth, and memongo creates an
+	// admin user with a random password before StartWithOptions returns. The
+	// credentials are available from Server.Username() and Server.Password(),
+	// and are included in Server.URI().
+	Auth bool
+
+	// The mechanism for the admin user when Auth is true:
+	// AuthMechanismSCRAMSHA1, AuthMechanismSCRAMSHA256 (which needs MongoDB
+	// 4.0 or later), or AuthMechanismX509. Defaults to SCRAM-SHA-256 on
+	// MongoDB 4.0 and later, and SCRAM-SHA-1 before that.
+	//
+	// AuthMechanismX509 implies TLS and TLSClientCertificate. The admin user
+	// authenticates with the generated client certificate, and
+	// Server.CreateX509User creates more users with their own certificates.
+	AuthMechanism string
+
+	// If TLS is true, memongo generates a throwaway CA and a certificate for
+	// localhost, and starts mongod requiring TLS. Connect with
+	// Server.TLSConfig(), which trusts the generated CA.
+	TLS bool
+
+	// If TLSClientCertificate is true (and TLS is), memongo also generates a
+	// client certificate, which Server.TLSConfig() presents, and mongod
+	// requires clients to present one. Otherwise, clients don't need a
+	// certificate.
+	TLSClientCertificate bool
+
+	// A comma-separated list of addresses for mongod to listen on, passed to
+	// --bind_ip (e.g. "::1" or "127.0.0.1,::1"). Defaults to mongod's own
+	// default, which is localhost on MongoDB 3.6 and later, and all
+	// interfaces before that. Server.URI() uses the address mongod reports
+	// it's listening on.
+	BindIP string
+
+	// If IPv6 is true, mongod is started with --ipv6. This is turned on
+	// automatically if BindIP includes an IPv6 address.
+	IPv6 bool
+
+	// If UnixSocket is true, mongod also listens on a Unix domain socket in
+	// its data directory. Connect to it with Server.SocketURI().
+	UnixSocket bool
+
+	// If DisableTCP is true, mongod only listens on a Unix domain socket, and
+	// Server.URI() connects over the socket. This avoids picking a port
+	// entirely. It implies UnixSocket, and can't be used with replica sets,
+	// whose members talk to each other over TCP.
+	DisableTCP bool
+
+	// Extra command-line arguments for mongod, such as
+	// []string{"--nounixsocket"}. These can't include options memongo
+	// manages, like --port, --dbpath, --storageEngine, --bind_ip, --auth, or
+	// the TLS options. They're only passed to mongod, not to mongos routers.
+	ExtraArgs []string
+
+	// Server parameters to pass to mongod with --setParameter, such as
+	// map[string]interface{}{"enableTestCommands": 1}. Values that are
+	// documents or arrays, like logComponentVerbosity's, are passed as JSON.
+	SetParameters map[string]interface{}
+
+	// If given, memongo writes these settings to a mongod config file in the
+	// data directory and starts mongod with it. Settings can be nested, like
+	// in the YAML file, e.g.
+	//
+	//  map[string]interface{}{"operationProfiling": map[string]interface{}{"mode": "all"}}
+	//
+	// Command-line options take precedence over the config file, so settings
+	// memongo manages (like net.port) can't be given.
+	Config map[string]interface{}
+
+	// If Proxy is true, memongo starts a TCP proxy in front of mongod, for
+	// simulating slow or broken networks. Connect through it with
+	// Server.ProxyURI(), and control it with Server.Proxy().
+	Proxy bool
+
+	// If given, OnCrash is called (from a background goroutine) when mongod
+	// exits after starting up, without being stopped by memongo. The crash is
+	// also logged, along with the last lines of mongod's output, and is
+	// available from Server.Err().
+	OnCrash func(err *CrashError)
+
+	// Whether to restart mongod if it crashes. By default, a crashed mongod
+	// stays down. See RestartPolicy.
+	Restart RestartPolicy
+
+	// If Sweep is true, memongo calls Sweep before starting mongod, to clean
+	// up data directories (and mongod processes) left behind by test
+	// processes that were killed without stopping their servers.
+	Sweep bool
 }
 
 func (opts *Options) fillDefaults() error {
 	if opts.MongodBin == "" {
 		opts.MongodBin = os.Getenv("MEMONGO_MONGOD_BIN")
 	}
+	if opts.MongosBin == "" {
+		opts.MongosBin = os.Getenv("MEMONGO_MONGOS_BIN")
+	}
+	if opts.MongosBin == "" && opts.MongodBin != "" {
+		opts.MongosBin = path.Join(path.Dir(opts.MongodBin), "mongos")
+	}
 	if opts.MongodBin == "" {
 		// The user didn't give us a local path to a binary. That means we need
 		// a download URL and a cache path.
@@ -102,43 +301,218 @@ func (opts *Options) fillDefaults() error {
 		}
 	}
 
-	if opts.Port == 0 {
-		// MongoDB after version 4 correctly reports what port it's running on if
-		// we tell it to run on port 0, which is ideal -- we just start it on port
-		// 0, the OS assigns a port, and mongo reports in the logs what port it
-		// got.
-		//
-		// For earlier versions, mongo just print "waiting for connections on port 0"
-		// which is unhelpful. So we start up a server and see what port we get,
-		// then shut down that server
-		if opts.MongoVersion == "" || parseMongoMajorVersion(opts.MongoVersion) < 4 {
-			port, err := getFreePort()
+	if !opts.PortRange.isSet() {
+		portRangeEnv := os.Getenv("MEMONGO_MONGOD_PORT_RANGE")
+		if portRangeEnv != "" {
+			portRange, err := parsePortRange(portRangeEnv)
 			if err != nil {
-				return fmt.Errorf("error finding a free port: %s", err)
+				return fmt.Errorf("error parsing MEMONGO_MONGOD_PORT_RANGE: %s", err)
 			}
 
-			opts.Port = port
+			opts.PortRange = portRange
+		}
+	}
+
+	if opts.PortRange.isSet() {
+		err := opts.PortRange.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.MaxPortRetries == 0 {
+		opts.MaxPortRetries = defaultMaxPortRetries
+	}
+
+	if opts.StartupTimeout == 0 {
+		opts.StartupTimeout = 10 * time.Second
+	}
+
+	if opts.ReplicaSet && opts.ReplicaSetName == "" {
+		opts.ReplicaSetName = defaultReplicaSetName
+	}
+
+	err := opts.validateExtraArgs()
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(opts.BindIP, ":") {
+		opts.IPv6 = true
+	}
+
+	if opts.DisableTCP {
+		if opts.ReplicaSet {
+			return errors.New("DisableTCP can't be used with replica sets")
+		}
+		if opts.BindIP != "" {
+			return errors.New("DisableTCP can't be used with BindIP")
+		}
+
+		opts.UnixSocket = true
+	}
+
+	return opts.Restart.fillDefaults()
+}
+
+// needsExplicitPort returns true if we need to pick a free port ourselves
+// rather than letting mongod choose one.
+func (opts *Options) needsExplicitPort() bool {
+	if opts.PortRange.isSet() {
+		return true
+	}
+
+	// MongoDB after version 4 correctly reports what port it's running on if
+	// we tell it to run on port 0, which is ideal -- we just start it on port
+	// 0, the OS assigns a port, and mongo reports in the logs what port it
+	// got.
+	//
+	// For earlier versions, mongo just print "waiting for connections on port 0"
+	// which is unhelpful. So we start up a server and see what port we get,
+	// then shut down that server
+	return opts.MongoVersion == "" || parseMongoMajorVersion(opts.MongoVersion) < 4
+}
+
+// fillVersionDefaults fills in the defaults that depend on the version of the
+// mongod binary we're running. If MongoVersion isn't given, it's detected by
+// running the binary with --version.
+func (opts *Options) fillVersionDefaults(ctx context.Context, binPath string) error {
+	if opts.MongoVersion == "" {
+		version, err := detectMongoVersion(ctx, binPath)
+		if err != nil {
+			opts.getLogger().Warnf("could not detect the version of %s: %s", binPath, err)
+		} else {
+			opts.MongoVersion = version
+		}
+	}
+
+	// ephemeralForTest was removed in 7.0
+	hasEphemeralForTest := opts.MongoVersion == "" || !mongoVersionAtLeast(opts.MongoVersion, 7, 0)
+
+	if opts.StorageEngine == "" {
+		if hasEphemeralForTest && !opts.ReplicaSet {
+			opts.StorageEngine = StorageEngineEphemeralForTest
+		} else {
+			opts.StorageEngine = StorageEngineWiredTiger
+		}
+	}
+
+	switch opts.StorageEngine {
+	case StorageEngineEphemeralForTest:
+		if !hasEphemeralForTest {
+			return fmt.Errorf("MongoDB %s does not support the ephemeralForTest storage engine, which was removed in 7.0", opts.MongoVersion)
+		}
+	case StorageEngineWiredTiger, StorageEngineInMemory:
+	default:
+		return fmt.Errorf("unknown storage engine %q", opts.StorageEngine)
+	}
+
+	if opts.Auth {
+		return opts.fillAuthDefaults()
+	}
+
+	return nil
+}
+
+// fillAuthDefaults picks and checks the auth mechanism when Auth is true
+func (opts *Options) fillAuthDefaults() error {
+	// SCRAM-SHA-256 was added in 4.0
+	hasSCRAMSHA256 := opts.MongoVersion != "" && mongoVersionAtLeast(opts.MongoVersion, 4, 0)
+
+	if opts.AuthMechanism == "" {
+		if hasSCRAMSHA256 {
+			opts.AuthMechanism = AuthMechanismSCRAMSHA256
+		} else {
+			opts.AuthMechanism = AuthMechanismSCRAMSHA1
 		}
+	}
 
-		if opts.StartupTimeout == 0 {
-			opts.StartupTimeout = 10 * time.Second
+	switch opts.AuthMechanism {
+	case AuthMechanismX509:
+		opts.TLS = true
+		opts.TLSClientCertificate = true
+	case AuthMechanismSCRAMSHA1:
+	case AuthMechanismSCRAMSHA256:
+		if !hasSCRAMSHA256 && opts.MongoVersion != "" {
+			return fmt.Errorf("MongoDB %s does not support SCRAM-SHA-256, which was added in 4.0", opts.MongoVersion)
 		}
+	default:
+		return fmt.Errorf("unknown auth mechanism %q", opts.AuthMechanism)
 	}
 
 	return nil
 }
 
+// storageEngineArgs returns the mongod arguments for the storage engine
+func (opts *Options) storageEngineArgs() []string {
+	args := []string{"--storageEngine", opts.StorageEngine}
+
+	// Let the user choose the cache size with ExtraArgs or Config
+	userCacheSize := opts.hasExtraArg("--wiredTigerCacheSizeGB") || opts.hasConfigSetting("storage.wiredTiger.engineConfig.cacheSizeGB")
+
+	if opts.StorageEngine == StorageEngineWiredTiger && !userCacheSize {
+		// The default cache is half of the system's RAM, which is far more
+		// than a test server needs. Before 3.4, the cache size had to be a
+		// whole number of gigabytes.
+		cacheSize := "0.25"
+		if opts.MongoVersion != "" && !mongoVersionAtLeast(opts.MongoVersion, 3, 4) {
+			cacheSize = "1"
+		}
+
+		args = append(args, "--wiredTigerCacheSizeGB", cacheSize)
+	}
+
+	return args
+}
+
+// dbDirRoot returns the directory to create data directories in, or "" for
+// the system temp directory. wiredTiger writes its data to disk, so we use a
+// RAM-backed directory if one is available.
+func (opts *Options) dbDirRoot() string {
+	if opts.StorageEngine != StorageEngineWiredTiger {
+		return ""
+	}
+
+	stat, err := os.Stat(ramDiskPath)
+	if err != nil || !stat.IsDir() {
+		return ""
+	}
+
+	// Check that we can actually write there
+	testDir, err := ioutil.TempDir(ramDiskPath, "")
+	if err != nil {
+		return ""
+	}
+	_ = os.Remove(testDir)
+
+	return ramDiskPath
+}
+
 func (opts *Options) getLogger() *memongolog.Logger {
 	return memongolog.New(opts.Logger, opts.LogLevel)
 }
 
-func (opts *Options) getOrDownloadBinPath() (string, error) {
+func (opts *Options) getOrDownloadBinPath(ctx context.Context) (string, error) {
 	if opts.MongodBin != "" {
 		return opts.MongodBin, nil
 	}
 
 	// Download or fetch from cache
-	binPath, err := mongobin.GetOrDownloadMongod(opts.DownloadURL, opts.CachePath, opts.getLogger())
+	binPath, err := mongobin.GetOrDownloadMongodContext(ctx, opts.DownloadURL, opts.CachePath, opts.getLogger())
+	if err != nil {
+		return "", err
+	}
+
+	return binPath, nil
+}
+
+func (opts *Options) getOrDownloadMongosBinPath(ctx context.Context) (string, error) {
+	if opts.MongosBin != "" {
+		return opts.MongosBin, nil
+	}
+
+	// Download or fetch from cache
+	binPath, err := mongobin.GetOrDownloadMongosContext(ctx, opts.DownloadURL, opts.CachePath, opts.getLogger())
 	if err != nil {
 		return "", err
 	}
@@ -146,6 +520,49 @@ func (opts *Options) getOrDownloadBinPath() (string, error) {
 	return binPath, nil
 }
 
+var reMongodVersion = regexp.MustCompile(`db version v(\d+\.\d+\.\d+)`)
+
+// detectMongoVersion runs mongod --version and parses the version number
+func detectMongoVersion(ctx context.Context, binPath string) (string, error) {
+	// We control binPath
+	//nolint:gosec
+	out, err := exec.CommandContext(ctx, binPath, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+
+	match := reMongodVersion.FindSubmatch(out)
+	if match == nil {
+		return "", fmt.Errorf("could not find a version number in %q", out)
+	}
+
+	return string(match[1]), nil
+}
+
+// mongoVersionAtLeast returns true if version is at least major.minor
+func mongoVersionAtLeast(version string, major int, minor int) bool {
+	versionMajor := parseMongoMajorVersion(version)
+	if versionMajor != major {
+		return versionMajor > major
+	}
+
+	return parseMongoMinorVersion(version) >= minor
+}
+
+func parseMongoMinorVersion(version string) int {
+	strParts := strings.Split(version, ".")
+	if len(strParts) < 2 {
+		return 0
+	}
+
+	minor, err := strconv.Atoi(strParts[1])
+	if err != nil {
+		return 0
+	}
+
+	return minor
+}
+
 func parseMongoMajorVersion(version string) int {
 	strParts := strings.Split(version, ".")
 	if len(strParts) == 0 {
@@ -160,6 +577,40 @@ func parseMongoMajorVersion(version string) int {
 	return maj
 }
 
+// pickFreePort picks a free port, from PortRange if it's set or from the OS
+// otherwise
+func (opts *Options) pickFreePort() (int, error) {
+	if !opts.PortRange.isSet() {
+		return getFreePort()
+	}
+
+	size := big.NewInt(int64(opts.PortRange.Max - opts.PortRange.Min + 1))
+	for i := 0; i < portRangeAttempts; i++ {
+		offset, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return 0, err
+		}
+
+		port := opts.PortRange.Min + int(offset.Int64())
+		if isPortFree(port) {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("could not find a free port in the range %d-%d", opts.PortRange.Min, opts.PortRange.Max)
+}
+
+// isPortFree returns true if we can listen on the given port
+func isPortFree(port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+
+	_ = l.Close()
+	return true
+}
+
 func getFreePort() (int, error) {
 	// Based on: https://github.com/phayes/freeport/blob/master/freeport.go
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
@@ -0,0 +1,276 @@
+package memongo
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMongoVersionAtLeast(t *testing.T) {
+	tests := map[string]struct {
+		version string
+		major   int
+		minor   int
+
+		expected bool
+	}{
+		"equal":          {version: "4.2.1", major: 4, minor: 2, expected: true},
+		"newer minor":    {version: "4.4.0", major: 4, minor: 2, expected: true},
+		"older minor":    {version: "4.0.13", major: 4, minor: 2, expected: false},
+		"newer major":    {version: "7.0.2", major: 4, minor: 4, expected: true},
+		"older major":    {version: "3.6.13", major: 4, minor: 0, expected: false},
+		"prerelease":     {version: "7.0.0-rc1", major: 7, minor: 0, expected: true},
+		"missing minor":  {version: "7", major: 7, minor: 0, expected: true},
+		"unparseable":    {version: "foo", major: 3, minor: 2, expected: false},
+		"empty":          {version: "", major: 3, minor: 2, expected: false},
+		"two-digit part": {version: "10.1.0", major: 9, minor: 0, expected: true},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, mongoVersionAtLeast(test.version, test.major, test.minor))
+		})
+	}
+}
+
+func TestFillVersionDefaultsStorageEngine(t *testing.T) {
+	tests := map[string]struct {
+		opts Options
+
+		expectedEngine string
+		expectedError  string
+	}{
+		"old version": {
+			opts:           Options{MongoVersion: "4.2.1"},
+			expectedEngine: StorageEngineEphemeralForTest,
+		},
+		"7.0": {
+			opts:           Options{MongoVersion: "7.0.2"},
+			expectedEngine: StorageEngineWiredTiger,
+		},
+		"replica set": {
+			opts:           Options{MongoVersion: "4.2.1", ReplicaSet: true},
+			expectedEngine: StorageEngineWiredTiger,
+		},
+		"explicit engine": {
+			opts:           Options{MongoVersion: "4.2.1", StorageEngine: StorageEngineInMemory},
+			expectedEngine: StorageEngineInMemory,
+		},
+		"ephemeralForTest on 7.0": {
+			opts:          Options{MongoVersion: "7.0.2", StorageEngine: StorageEngineEphemeralForTest},
+			expectedError: "MongoDB 7.0.2 does not support the ephemeralForTest storage engine, which was removed in 7.0",
+		},
+		"unknown engine": {
+			opts:          Options{MongoVersion: "4.2.1", StorageEngine: "mmapv2"},
+			expectedError: "unknown storage engine \"mmapv2\"",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			opts := test.opts
+			err := opts.fillVersionDefaults(context.Background(), "/nonexistent/mongod")
+
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedEngine, opts.StorageEngine)
+		})
+	}
+}
+
+func TestFillVersionDefaultsAuthMechanism(t *testing.T) {
+	tests := map[string]struct {
+		opts Options
+
+		expectedMechanism string
+		expectedError     string
+	}{
+		"old version": {
+			opts:              Options{MongoVersion: "3.6.13", Auth: true},
+			expectedMechanism: AuthMechanismSCRAMSHA1,
+		},
+		"4.0": {
+			opts:              Options{MongoVersion: "4.0.13", Auth: true},
+			expectedMechanism: AuthMechanismSCRAMSHA256,
+		},
+		"explicit SCRAM-SHA-1": {
+			opts:              Options{MongoVersion: "4.2.1", Auth: true, AuthMechanism: AuthMechanismSCRAMSHA1},
+			expectedMechanism: AuthMechanismSCRAMSHA1,
+		},
+		"SCRAM-SHA-256 on old version": {
+			opts:          Options{MongoVersion: "3.6.13", Auth: true, AuthMechanism: AuthMechanismSCRAMSHA256},
+			expectedError: "MongoDB 3.6.13 does not support SCRAM-SHA-256, which was added in 4.0",
+		},
+		"x509": {
+			opts:              Options{MongoVersion: "3.6.13", Auth: true, AuthMechanism: AuthMechanismX509},
+			expectedMechanism: AuthMechanismX509,
+		},
+		"unknown mechanism": {
+			opts:          Options{MongoVersion: "4.2.1", Auth: true, AuthMechanism: "MONGODB-CR"},
+			expectedError: "unknown auth mechanism \"MONGODB-CR\"",
+		},
+		"auth disabled": {
+			opts:              Options{MongoVersion: "4.2.1"},
+			expectedMechanism: "",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			opts := test.opts
+			err := opts.fillVersionDefaults(context.Background(), "/nonexistent/mongod")
+
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedMechanism, opts.AuthMechanism)
+
+			// x509 needs client certificates
+			isX509 := test.expectedMechanism == AuthMechanismX509
+			assert.Equal(t, isX509, opts.TLS)
+			assert.Equal(t, isX509, opts.TLSClientCertificate)
+		})
+	}
+}
+
+func TestStorageEngineArgs(t *testing.T) {
+	opts := Options{MongoVersion: "7.0.2", StorageEngine: StorageEngineWiredTiger}
+	assert.Equal(t, []string{"--storageEngine", "wiredTiger", "--wiredTigerCacheSizeGB", "0.25"}, opts.storageEngineArgs())
+
+	opts = Options{MongoVersion: "3.2.22", StorageEngine: StorageEngineWiredTiger}
+	assert.Equal(t, []string{"--storageEngine", "wiredTiger", "--wiredTigerCacheSizeGB", "1"}, opts.storageEngineArgs())
+
+	opts = Options{MongoVersion: "4.2.1", StorageEngine: StorageEngineEphemeralForTest}
+	assert.Equal(t, []string{"--storageEngine", "ephemeralForTest"}, opts.storageEngineArgs())
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := map[string]struct {
+		str string
+
+		expected      PortRange
+		expectedError string
+	}{
+		"valid":          {str: "27100-27200", expected: PortRange{Min: 27100, Max: 27200}},
+		"spaces":         {str: "27100 - 27200", expected: PortRange{Min: 27100, Max: 27200}},
+		"single port":    {str: "27100-27100", expected: PortRange{Min: 27100, Max: 27100}},
+		"missing max":    {str: "27100", expectedError: "port range \"27100\" is not in the form min-max"},
+		"not a number":   {str: "a-27200", expectedError: "could not parse port range \"a-27200\": strconv.Atoi: parsing \"a\": invalid syntax"},
+		"backwards":      {str: "27200-27100", expectedError: "invalid port range 27200-27100"},
+		"out of range":   {str: "60000-70000", expectedError: "invalid port range 60000-70000"},
+		"zero min":       {str: "0-100", expectedError: "invalid port range 0-100"},
+		"negative":       {str: "-1-100", expectedError: "port range \"-1-100\" is not in the form min-max"},
+		"too many parts": {str: "1-2-3", expectedError: "port range \"1-2-3\" is not in the form min-max"},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			portRange, err := parsePortRange(test.str)
+
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, portRange)
+		})
+	}
+}
+
+func TestPickFreePortFromRange(t *testing.T) {
+	opts := Options{PortRange: PortRange{Min: 27100, Max: 27110}}
+
+	for i := 0; i < 20; i++ {
+		port, err := opts.pickFreePort()
+		require.NoError(t, err)
+
+		assert.True(t, port >= 27100 && port <= 27110, "port %d out of range", port)
+	}
+}
+
+func TestPickFreePortFromRangeInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	opts := Options{PortRange: PortRange{Min: port, Max: port}}
+
+	_, err = opts.pickFreePort()
+	require.Error(t, err)
+}
+
+func TestDisableTCP(t *testing.T) {
+	opts := Options{MongodBin: "/nonexistent/mongod", DisableTCP: true}
+	require.NoError(t, opts.fillDefaults())
+	assert.True(t, opts.UnixSocket)
+
+	opts = Options{MongodBin: "/nonexistent/mongod", DisableTCP: true, ReplicaSet: true}
+	require.EqualError(t, opts.fillDefaults(), "DisableTCP can't be used with replica sets")
+
+	opts = Options{MongodBin: "/nonexistent/mongod", DisableTCP: true, BindIP: "127.0.0.1"}
+	require.EqualError(t, opts.fillDefaults(), "DisableTCP can't be used with BindIP")
+}
+
+func TestBindIPEnablesIPv6(t *testing.T) {
+	opts := Options{MongodBin: "/nonexistent/mongod", BindIP: "127.0.0.1"}
+	require.NoError(t, opts.fillDefaults())
+	assert.False(t, opts.IPv6)
+
+	opts = Options{MongodBin: "/nonexistent/mongod", BindIP: "127.0.0.1,::1"}
+	require.NoError(t, opts.fillDefaults())
+	assert.True(t, opts.IPv6)
+}
+
+func TestRestartPolicyDefaults(t *testing.T) {
+	tests := map[string]struct {
+		policy RestartPolicy
+
+		expected      RestartPolicy
+		expectedError string
+	}{
+		"default": {
+			policy:   RestartPolicy{},
+			expected: RestartPolicy{Mode: RestartNever},
+		},
+		"on failure": {
+			policy:   RestartPolicy{Mode: RestartOnFailure},
+			expected: RestartPolicy{Mode: RestartOnFailure, MaxAttempts: 5, Backoff: time.Second},
+		},
+		"explicit settings": {
+			policy:   RestartPolicy{Mode: RestartOnFailure, MaxAttempts: 2, Backoff: time.Minute},
+			expected: RestartPolicy{Mode: RestartOnFailure, MaxAttempts: 2, Backoff: time.Minute},
+		},
+		"unknown mode": {
+			policy:        RestartPolicy{Mode: "always"},
+			expectedError: "unknown restart mode \"always\"",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			policy := test.policy
+			err := policy.fillDefaults()
+
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, policy)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package memongo
+
+// Done returns a channel that's closed when the mongod process exits, whether
+// it was stopped or it crashed. Use Err to find out which. If mongod is
+// restarted after a crash (see Options.Restart), the restarted process has a
+// new Done channel.
+func (s *Server) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.exited
+}
+
+// Err returns a *CrashError if mongod exited after starting up without being
+// stopped by memongo. It returns nil while mongod is running, and after it's
+// been stopped.
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashErr == nil {
+		return nil
+	}
+
+	return s.crashErr
+}
+
+// setRunning records whether mongod is up and running. It's set once mongod
+// has started, and cleared before memongo stops it, so that the exit isn't
+// reported as a crash.
+func (s *Server) setRunning(running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running = running
+	if running {
+		s.crashErr = nil
+	}
+}
+
+// recordExit is called when the mongod process has exited and been reaped. If
+// mongod was running, it crashed: recordExit logs the crash and returns a
+// *CrashError describing it. Otherwise, it returns nil.
+func (s *Server) recordExit() *CrashError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return nil
+	}
+
+	s.running = false
+
+	crashErr := &CrashError{LogTail: s.output.snapshot()}
+	crashErr.ExitCode, crashErr.Signal = exitStatus(s.exitErr)
+	s.crashErr = crashErr
+
+	s.logger.Warnf("mongod on port %d: %s", s.port, crashErr)
+
+	return crashErr
+}
@@ -0,0 +1,44 @@
+package memongo
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/benweissmann/memongo/memongolog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordExit(t *testing.T) {
+	output := newLogTail(startupErrorLogLines)
+	output.add("Invalid access at address: 0")
+
+	server := &Server{
+		opts:    &Options{},
+		logger:  memongolog.New(nil, memongolog.LogLevelSilent),
+		output:  output,
+		exitErr: exec.Command("/bin/sh", "-c", "kill -SEGV $$").Run(),
+	}
+
+	// An exit while memongo isn't running mongod (during startup or while
+	// stopping it) isn't a crash
+	assert.Nil(t, server.recordExit())
+	assert.NoError(t, server.Err())
+
+	server.setRunning(true)
+
+	crashErr := server.recordExit()
+	require.NotNil(t, crashErr)
+	assert.Equal(t, -1, crashErr.ExitCode)
+	assert.Equal(t, "segmentation fault", crashErr.Signal)
+	assert.Equal(t, []string{"Invalid access at address: 0"}, crashErr.LogTail)
+	assert.Equal(t, crashErr, server.Err())
+
+	// A crash is only reported once
+	assert.Nil(t, server.recordExit())
+
+	// Starting up again clears it
+	server.setRunning(true)
+	assert.NoError(t, server.Err())
+}
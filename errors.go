@@ -0,0 +1,225 @@
+package memongo
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Errors describing why mongod failed to start. Start and friends return a
+// *StartupError wrapping one of these, so you can check for them with
+// errors.Is.
+var (
+	// ErrPortInUse means mongod couldn't listen on its port because something
+	// else is using it
+	ErrPortInUse = errors.New("address in use")
+
+	// ErrAlreadyRunning means another mongod is using the data directory
+	ErrAlreadyRunning = errors.New("already running")
+
+	// ErrPermissionDenied means mongod was denied access to a file or port
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrDataDirNotFound means mongod's data directory doesn't exist
+	ErrDataDirNotFound = errors.New("data directory not found")
+
+	// ErrFatalError means mongod logged a fatal error, such as a failed
+	// assertion
+	ErrFatalError = errors.New("fatal error")
+
+	// ErrServerShutDown means mongod shut itself down during startup
+	ErrServerShutDown = errors.New("server shut down")
+
+	// ErrStartupTimeout means mongod didn't become ready within
+	// Options.StartupTimeout
+	ErrStartupTimeout = errors.New("timed out waiting for mongod to start")
+
+	// ErrExitedEarly means mongod exited before it became ready, without
+	// logging a recognizable reason
+	ErrExitedEarly = errors.New("mongod exited before startup completed")
+)
+
+// ErrNotRunning means an operation needs a running mongod process, but it
+// has been stopped or has exited
+var ErrNotRunning = errors.New("mongod is not running")
+
+// The number of lines of mongod output to keep for StartupError
+const startupErrorLogLines = 30
+
+// StartupError is returned when mongod fails to start. It wraps one of the
+// Err* values above (or another underlying error), and includes details to
+// help debug the failure.
+type StartupError struct {
+	// The reason startup failed, usually one of the Err* values
+	Err error
+
+	// The log line that reported the failure, if there was one
+	LogLine string
+
+	// The command line mongod was started with
+	Command []string
+
+	// mongod's exit code, or -1 if it didn't exit on its own (memongo kills
+	// mongod if it's still running after a failed startup)
+	ExitCode int
+
+	// The name of the signal that killed mongod, if it was killed by one
+	Signal string
+
+	// The last lines of mongod's stdout and stderr
+	LogTail []string
+}
+
+func (e *StartupError) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "mongod startup failed: %s", e.Err)
+	if e.LogLine != "" {
+		fmt.Fprintf(&b, ": %s", e.LogLine)
+	}
+
+	if len(e.Command) > 0 {
+		fmt.Fprintf(&b, "\ncommand: %s", strings.Join(e.Command, " "))
+	}
+
+	if e.ExitCode >= 0 {
+		fmt.Fprintf(&b, "\nexit code: %d", e.ExitCode)
+	} else if e.Signal != "" {
+		fmt.Fprintf(&b, "\nkilled by signal: %s", e.Signal)
+	}
+
+	if len(e.LogTail) > 0 {
+		fmt.Fprintf(&b, "\nlast %d lines of output:", len(e.LogTail))
+		for _, line := range e.LogTail {
+			fmt.Fprintf(&b, "\n  %s", line)
+		}
+	}
+
+	return b.String()
+}
+
+// Unwrap returns the reason startup failed, for use with errors.Is and
+// errors.As
+func (e *StartupError) Unwrap() error {
+	return e.Err
+}
+
+// CrashError describes mongod exiting unexpectedly after it started up, for
+// example because it segfaulted or was killed by the OOM killer.
+type CrashError struct {
+	// mongod's exit code, or -1 if it was killed by a signal
+	ExitCode int
+
+	// The name of the signal that killed mongod, if it was killed by one
+	Signal string
+
+	// The last lines of mongod's stdout and stderr
+	LogTail []string
+}
+
+func (e *CrashError) Error() string {
+	var b strings.Builder
+
+	b.WriteString("mongod exited unexpectedly")
+	if e.ExitCode >= 0 {
+		fmt.Fprintf(&b, " with exit code %d", e.ExitCode)
+	} else if e.Signal != "" {
+		fmt.Fprintf(&b, ", killed by signal %s", e.Signal)
+	}
+
+	if len(e.LogTail) > 0 {
+		fmt.Fprintf(&b, "\nlast %d lines of output:", len(e.LogTail))
+		for _, line := range e.LogTail {
+			fmt.Fprintf(&b, "\n  %s", line)
+		}
+	}
+
+	return b.String()
+}
+
+// exitStatus returns the exit code and signal from the result of cmd.Wait().
+// The exit code is -1 if the process was killed by a signal.
+func exitStatus(waitErr error) (int, string) {
+	if waitErr == nil {
+		return 0, ""
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(waitErr, &exitErr) {
+		return -1, ""
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return exitErr.ExitCode(), ""
+	}
+
+	if status.Signaled() {
+		return -1, status.Signal().String()
+	}
+
+	return status.ExitStatus(), ""
+}
+
+// logTail keeps the last few lines of mongod's output. It's safe for
+// concurrent use.
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+}
+
+func newLogTail(max int) *logTail {
+	return &logTail{max: max}
+}
+
+func (t *logTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// snapshot returns a copy of the lines currently in the tail
+func (t *logTail) snapshot() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]string(nil), t.lines...)
+}
+
+// multiError combines several errors into one. It's used when tearing down
+// servers, where we want to keep cleaning up after the first error.
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// add appends err, if it's not nil
+func (m *multiError) add(err error) {
+	if err != nil {
+		*m = append(*m, err)
+	}
+}
+
+// errOrNil returns nil if there are no errors, so callers don't return a
+// non-nil error interface holding an empty multiError
+func (m multiError) errOrNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+
+	return m
+}
@@ -0,0 +1,76 @@
+package memongo
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupError(t *testing.T) {
+	err := error(&StartupError{
+		Err:      ErrPortInUse,
+		LogLine:  "Failed to set up listener: SocketException: Address already in use",
+		Command:  []string{"mongod", "--port", "1234"},
+		ExitCode: 48,
+		LogTail:  []string{"MongoDB starting", "Failed to set up listener: SocketException: Address already in use"},
+	})
+
+	wrapped := fmt.Errorf("starting replica set member: %w", err)
+
+	assert.True(t, errors.Is(wrapped, ErrPortInUse))
+	assert.False(t, errors.Is(wrapped, ErrStartupTimeout))
+
+	var startupErr *StartupError
+	require.True(t, errors.As(wrapped, &startupErr))
+	assert.Equal(t, 48, startupErr.ExitCode)
+
+	assert.Equal(t, "mongod startup failed: address in use: Failed to set up listener: SocketException: Address already in use\n"+
+		"command: mongod --port 1234\n"+
+		"exit code: 48\n"+
+		"last 2 lines of output:\n"+
+		"  MongoDB starting\n"+
+		"  Failed to set up listener: SocketException: Address already in use", err.Error())
+
+	err = &StartupError{Err: ErrStartupTimeout, ExitCode: -1, Signal: "killed"}
+	assert.Equal(t, "mongod startup failed: timed out waiting for mongod to start\nkilled by signal: killed", err.Error())
+}
+
+func TestCrashError(t *testing.T) {
+	err := &CrashError{ExitCode: -1, Signal: "segmentation fault", LogTail: []string{"Invalid access at address: 0"}}
+	assert.Equal(t, "mongod exited unexpectedly, killed by signal segmentation fault\n"+
+		"last 1 lines of output:\n"+
+		"  Invalid access at address: 0", err.Error())
+
+	err = &CrashError{ExitCode: 14}
+	assert.Equal(t, "mongod exited unexpectedly with exit code 14", err.Error())
+}
+
+func TestExitStatus(t *testing.T) {
+	code, signal := exitStatus(nil)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "", signal)
+
+	code, signal = exitStatus(exec.Command("/bin/sh", "-c", "exit 48").Run())
+	assert.Equal(t, 48, code)
+	assert.Equal(t, "", signal)
+
+	code, signal = exitStatus(exec.Command("/bin/sh", "-c", "kill -9 $$").Run())
+	assert.Equal(t, -1, code)
+	assert.Equal(t, "killed", signal)
+}
+
+func TestLogTail(t *testing.T) {
+	tail := newLogTail(3)
+
+	tail.add("one")
+	tail.add("two")
+	assert.Equal(t, []string{"one", "two"}, tail.snapshot())
+
+	tail.add("three")
+	tail.add("four")
+	assert.Equal(t, []string{"two", "three", "four"}, tail.snapshot())
+}
@@ -0,0 +1,211 @@
+package memongo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The mongod options memongo manages itself, which can't be given in
+// Options.ExtraArgs. Logging to a file or syslog would stop us from seeing
+// when mongod is ready, and forking would stop us from supervising it. The
+// others would stop memongo from connecting to mongod, or make URI() wrong;
+// use the corresponding fields of Options instead.
+var managedArgs = []string{
+	"--port", "--dbpath", "--storageEngine", "--replSet", "--config", "-f", "--fork", "--logpath", "--syslog",
+	"--bind_ip", "--bind_ip_all", "--ipv6", "--auth", "--keyFile",
+	"--tlsMode", "--tlsCertificateKeyFile", "--tlsCAFile", "--tlsAllowConnectionsWithoutCertificates",
+	"--sslMode", "--sslOnNormalPorts", "--sslPEMKeyFile", "--sslCAFile", "--sslAllowConnectionsWithoutCertificates",
+}
+
+// The config file settings that correspond to managedArgs, which can't be
+// given in Options.Config
+var managedConfigSettings = []string{
+	"net.port", "storage.dbPath", "storage.engine", "replication.replSetName", "processManagement.fork", "systemLog.destination", "systemLog.path",
+	"net.bindIp", "net.bindIpAll", "net.ipv6", "security.authorization", "security.keyFile", "net.tls", "net.ssl",
+}
+
+// The options and config file settings memongo manages when Options.UnixSocket
+// (or DisableTCP) is set
+var (
+	managedSocketArgs           = []string{"--unixSocketPrefix", "--nounixsocket"}
+	managedSocketConfigSettings = []string{"net.unixDomainSocket"}
+)
+
+// The name of the generated config file in the server's data directory
+const configFileName = "mongod.conf"
+
+// validateExtraArgs returns an error if ExtraArgs, SetParameters, or Config
+// would override an option memongo manages
+func (opts *Options) validateExtraArgs() error {
+	args, configSettings := managedArgs, managedConfigSettings
+	if opts.UnixSocket || opts.DisableTCP {
+		args = append(args[:len(args):len(args)], managedSocketArgs...)
+		configSettings = append(configSettings[:len(configSettings):len(configSettings)], managedSocketConfigSettings...)
+	}
+
+	for _, arg := range opts.ExtraArgs {
+		for _, managed := range args {
+			if argName(arg) == managed {
+				return fmt.Errorf("%s can't be given in ExtraArgs, because memongo sets it", managed)
+			}
+		}
+	}
+
+	for _, setting := range flattenConfig("", opts.Config) {
+		for _, managed := range configSettings {
+			// A setting that contains a managed one (like "net" given as
+			// something other than a map) would replace it too
+			if setting == managed || strings.HasPrefix(setting, managed+".") || strings.HasPrefix(managed, setting+".") {
+				return fmt.Errorf("%s can't be given in Config, because memongo sets it", managed)
+			}
+		}
+	}
+
+	for name := range opts.SetParameters {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid parameter name %q in SetParameters", name)
+		}
+
+		_, err := setParameterValue(opts.SetParameters[name])
+		if err != nil {
+			return fmt.Errorf("invalid value for parameter %s in SetParameters: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// argName returns the name of a command-line option, without any =value
+func argName(arg string) string {
+	return strings.SplitN(arg, "=", 2)[0]
+}
+
+// hasExtraArg returns true if the given option is in ExtraArgs
+func (opts *Options) hasExtraArg(name string) bool {
+	for _, arg := range opts.ExtraArgs {
+		if argName(arg) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasConfigSetting returns true if the given dotted setting (e.g.
+// "storage.wiredTiger.engineConfig.cacheSizeGB") is in Config
+func (opts *Options) hasConfigSetting(setting string) bool {
+	for _, s := range flattenConfig("", opts.Config) {
+		if s == setting {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flattenConfig returns the dotted names of all the settings in a config
+// map. Keys that are already dotted are passed through, so they're checked
+// just like the equivalent nested maps.
+func flattenConfig(prefix string, config map[string]interface{}) []string {
+	return flattenConfigMap(prefix, reflect.ValueOf(config))
+}
+
+// flattenConfigMap flattens a config map of any type, so typed nested maps
+// (like map[string]string) are checked too
+func flattenConfigMap(prefix string, config reflect.Value) []string {
+	var settings []string
+
+	for _, key := range config.MapKeys() {
+		name := fmt.Sprintf("%v", key.Interface())
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		value := reflect.ValueOf(config.MapIndex(key).Interface())
+		if value.Kind() == reflect.Map {
+			settings = append(settings, flattenConfigMap(name, value)...)
+		} else {
+			settings = append(settings, name)
+		}
+	}
+
+	return settings
+}
+
+// setParameterValue formats a SetParameters value for --setParameter.
+// mongod parses non-scalar values (like the document for
+// logComponentVerbosity) as JSON, so maps, slices, and structs are
+// JSON-encoded; everything else is formatted as is.
+func setParameterValue(value interface{}) (string, error) {
+	if value == nil {
+		return fmt.Sprintf("%v", value), nil
+	}
+
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+
+		return string(encoded), nil
+	}
+
+	return fmt.Sprintf("%v", value), nil
+}
+
+// setParameterArgs returns a --setParameter argument for each of
+// SetParameters, in a stable order. Values have already been checked by
+// validateExtraArgs.
+func (opts *Options) setParameterArgs() []string {
+	names := make([]string, 0, len(opts.SetParameters))
+	for name := range opts.SetParameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		value, _ := setParameterValue(opts.SetParameters[name])
+		args = append(args, "--setParameter", name+"="+value)
+	}
+
+	return args
+}
+
+// writeConfigFile renders Config to a mongod config file in dir, and returns
+// its path. mongod's config files are YAML; we write JSON, which is also
+// valid YAML, so we don't need a YAML library.
+func (opts *Options) writeConfigFile(dir string) (string, error) {
+	contents, err := json.MarshalIndent(opts.Config, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error rendering mongod config file: %s", err)
+	}
+
+	configFile := path.Join(dir, configFileName)
+
+	err = ioutil.WriteFile(configFile, contents, 0600)
+	if err != nil {
+		return "", fmt.Errorf("error writing mongod config file: %s", err)
+	}
+
+	return configFile, nil
+}
+
+// extraArgs returns the mongod arguments from ExtraArgs, SetParameters, and
+// the config file (if there is one)
+func (s *Server) extraArgs() []string {
+	var args []string
+	if s.configFile != "" {
+		args = append(args, "--config", s.configFile)
+	}
+
+	args = append(args, s.opts.setParameterArgs()...)
+
+	return append(args, s.opts.ExtraArgs...)
+}
@@ -0,0 +1,203 @@
+package memongo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateExtraArgs(t *testing.T) {
+	tests := map[string]struct {
+		opts Options
+
+		expectedError string
+	}{
+		"none": {
+			opts: Options{},
+		},
+		"allowed": {
+			opts: Options{
+				ExtraArgs:     []string{"--nounixsocket", "--wiredTigerCacheSizeGB", "0.5"},
+				SetParameters: map[string]interface{}{"enableTestCommands": 1},
+				Config:        map[string]interface{}{"operationProfiling": map[string]interface{}{"mode": "all"}},
+			},
+		},
+		"port": {
+			opts:          Options{ExtraArgs: []string{"--port", "1234"}},
+			expectedError: "--port can't be given in ExtraArgs, because memongo sets it",
+		},
+		"dbpath with equals": {
+			opts:          Options{ExtraArgs: []string{"--dbpath=/tmp/db"}},
+			expectedError: "--dbpath can't be given in ExtraArgs, because memongo sets it",
+		},
+		"storage engine": {
+			opts:          Options{ExtraArgs: []string{"--storageEngine", "mmapv1"}},
+			expectedError: "--storageEngine can't be given in ExtraArgs, because memongo sets it",
+		},
+		"config alias": {
+			opts:          Options{ExtraArgs: []string{"-f", "/tmp/mongod.conf"}},
+			expectedError: "-f can't be given in ExtraArgs, because memongo sets it",
+		},
+		"bind ip": {
+			opts:          Options{ExtraArgs: []string{"--bind_ip_all"}},
+			expectedError: "--bind_ip_all can't be given in ExtraArgs, because memongo sets it",
+		},
+		"ipv6": {
+			opts:          Options{ExtraArgs: []string{"--ipv6"}},
+			expectedError: "--ipv6 can't be given in ExtraArgs, because memongo sets it",
+		},
+		"auth": {
+			opts:          Options{ExtraArgs: []string{"--auth"}},
+			expectedError: "--auth can't be given in ExtraArgs, because memongo sets it",
+		},
+		"tls": {
+			opts:          Options{ExtraArgs: []string{"--tlsMode=requireTLS"}},
+			expectedError: "--tlsMode can't be given in ExtraArgs, because memongo sets it",
+		},
+		"ssl": {
+			opts:          Options{ExtraArgs: []string{"--sslPEMKeyFile", "/tmp/server.pem"}},
+			expectedError: "--sslPEMKeyFile can't be given in ExtraArgs, because memongo sets it",
+		},
+		"unix socket": {
+			opts:          Options{UnixSocket: true, ExtraArgs: []string{"--nounixsocket"}},
+			expectedError: "--nounixsocket can't be given in ExtraArgs, because memongo sets it",
+		},
+		"unix socket prefix": {
+			opts:          Options{DisableTCP: true, ExtraArgs: []string{"--unixSocketPrefix", "/tmp"}},
+			expectedError: "--unixSocketPrefix can't be given in ExtraArgs, because memongo sets it",
+		},
+		"nested config": {
+			opts:          Options{Config: map[string]interface{}{"net": map[string]interface{}{"port": 1234}}},
+			expectedError: "net.port can't be given in Config, because memongo sets it",
+		},
+		"typed nested config": {
+			opts:          Options{Config: map[string]interface{}{"net": map[string]string{"port": "1234"}}},
+			expectedError: "net.port can't be given in Config, because memongo sets it",
+		},
+		"config section that isn't a map": {
+			opts:          Options{Config: map[string]interface{}{"systemLog": struct{ Path string }{"/tmp/log"}}},
+			expectedError: "systemLog.destination can't be given in Config, because memongo sets it",
+		},
+		"dotted config": {
+			opts:          Options{Config: map[string]interface{}{"storage.dbPath": "/tmp/db"}},
+			expectedError: "storage.dbPath can't be given in Config, because memongo sets it",
+		},
+		"config section": {
+			opts:          Options{Config: map[string]interface{}{"systemLog": map[string]interface{}{"path": "/tmp/log"}}},
+			expectedError: "systemLog.path can't be given in Config, because memongo sets it",
+		},
+		"bind ip config": {
+			opts:          Options{Config: map[string]interface{}{"net": map[string]interface{}{"bindIp": "0.0.0.0"}}},
+			expectedError: "net.bindIp can't be given in Config, because memongo sets it",
+		},
+		"tls config": {
+			opts:          Options{Config: map[string]interface{}{"net.tls.mode": "requireTLS"}},
+			expectedError: "net.tls can't be given in Config, because memongo sets it",
+		},
+		"ssl config": {
+			opts:          Options{Config: map[string]interface{}{"net": map[string]interface{}{"ssl": map[string]interface{}{"mode": "requireSSL"}}}},
+			expectedError: "net.ssl can't be given in Config, because memongo sets it",
+		},
+		"authorization config": {
+			opts:          Options{Config: map[string]interface{}{"security": map[string]interface{}{"authorization": "enabled"}}},
+			expectedError: "security.authorization can't be given in Config, because memongo sets it",
+		},
+		"unix socket config": {
+			opts:          Options{UnixSocket: true, Config: map[string]interface{}{"net.unixDomainSocket.enabled": false}},
+			expectedError: "net.unixDomainSocket can't be given in Config, because memongo sets it",
+		},
+		"unix socket config without a socket": {
+			opts: Options{Config: map[string]interface{}{"net.unixDomainSocket.enabled": false}},
+		},
+		"bad parameter": {
+			opts:          Options{SetParameters: map[string]interface{}{"a=b": 1}},
+			expectedError: "invalid parameter name \"a=b\" in SetParameters",
+		},
+		"bad parameter value": {
+			opts:          Options{SetParameters: map[string]interface{}{"a": map[string]interface{}{"b": make(chan int)}}},
+			expectedError: "invalid value for parameter a in SetParameters: json: unsupported type: chan int",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := test.opts.validateExtraArgs()
+
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestFlattenConfig(t *testing.T) {
+	settings := flattenConfig("", map[string]interface{}{
+		"net": map[string]interface{}{
+			"compression":            map[string]interface{}{"compressors": "zstd"},
+			"maxIncomingConnections": 10,
+			"unixDomainSocket":       map[string]bool{"enabled": false},
+		},
+		"storage.journal.enabled": false,
+	})
+	sort.Strings(settings)
+
+	assert.Equal(t, []string{"net.compression.compressors", "net.maxIncomingConnections", "net.unixDomainSocket.enabled", "storage.journal.enabled"}, settings)
+}
+
+func TestExtraArgs(t *testing.T) {
+	server := &Server{
+		opts: &Options{
+			ExtraArgs: []string{"--nounixsocket"},
+			SetParameters: map[string]interface{}{
+				"enableTestCommands":              1,
+				"diagnosticDataCollectionEnabled": false,
+				"logComponentVerbosity":           map[string]interface{}{"verbosity": 1, "storage": map[string]interface{}{"journal": 2}},
+			},
+		},
+		configFile: "/tmp/1234/mongod.conf",
+	}
+
+	assert.Equal(t, []string{
+		"--config", "/tmp/1234/mongod.conf",
+		"--setParameter", "diagnosticDataCollectionEnabled=false",
+		"--setParameter", "enableTestCommands=1",
+		"--setParameter", `logComponentVerbosity={"storage":{"journal":2},"verbosity":1}`,
+		"--nounixsocket",
+	}, server.extraArgs())
+}
+
+func TestUserCacheSize(t *testing.T) {
+	opts := Options{MongoVersion: "4.2.1", StorageEngine: StorageEngineWiredTiger, ExtraArgs: []string{"--wiredTigerCacheSizeGB", "2"}}
+	assert.Equal(t, []string{"--storageEngine", "wiredTiger"}, opts.storageEngineArgs())
+
+	opts = Options{MongoVersion: "4.2.1", StorageEngine: StorageEngineWiredTiger, Config: map[string]interface{}{
+		"storage": map[string]interface{}{"wiredTiger": map[string]interface{}{"engineConfig": map[string]interface{}{"cacheSizeGB": 2}}},
+	}}
+	assert.Equal(t, []string{"--storageEngine", "wiredTiger"}, opts.storageEngineArgs())
+}
+
+func TestWriteConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := Options{Config: map[string]interface{}{"operationProfiling": map[string]interface{}{"mode": "all"}}}
+
+	configFile, err := opts.writeConfigFile(dir)
+	require.NoError(t, err)
+
+	contents, err := ioutil.ReadFile(configFile)
+	require.NoError(t, err)
+
+	var parsed map[string]interface{}
+	require.NoError(t, json.Unmarshal(contents, &parsed))
+	assert.Equal(t, opts.Config, parsed)
+}
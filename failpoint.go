@@ -0,0 +1,186 @@
+package memongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FailPointAlwaysOn is the fail point mode that keeps it active until it's
+// disabled
+const FailPointAlwaysOn = "alwaysOn"
+
+// FailPointTimes returns a fail point mode that's active for the next n times
+// the fail point is hit
+func FailPointTimes(n int) interface{} {
+	return bson.D{{Key: "times", Value: n}}
+}
+
+// FailPointSkip returns a fail point mode that's inactive for the next n
+// times the fail point is hit, and active after that
+func FailPointSkip(n int) interface{} {
+	return bson.D{{Key: "skip", Value: n}}
+}
+
+// Error codes that are handy with FailCommand for testing retry logic. See
+// https://github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.yml
+const (
+	ErrorCodeHostUnreachable    = 6
+	ErrorCodeShutdownInProgress = 91
+	ErrorCodePrimarySteppedDown = 189
+	ErrorCodeNotWritablePrimary = 10107
+)
+
+// FailPoint is a fail point enabled with Server.EnableFailPoint
+type FailPoint struct {
+	server *Server
+	name   string
+
+	mu       sync.Mutex
+	disabled bool
+}
+
+// EnableFailPoint turns on one of mongod's fail points with the given mode
+// (FailPointAlwaysOn, FailPointTimes(n), or FailPointSkip(n)) and data (which
+// may be nil). Fail points need test commands, so mongod must be started with
+// SetParameters: map[string]interface{}{"enableTestCommands": 1}.
+//
+// The returned FailPoint's Disable() is safe to defer:
+//
+//	fp, err := server.EnableFailPoint("failCommand", memongo.FailPointTimes(1), data)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer fp.Disable()
+func (s *Server) EnableFailPoint(name string, mode interface{}, data map[string]interface{}) (*FailPoint, error) {
+	command := bson.D{
+		{Key: "configureFailPoint", Value: name},
+		{Key: "mode", Value: mode},
+	}
+	if data != nil {
+		command = append(command, bson.E{Key: "data", Value: data})
+	}
+
+	err := s.configureFailPoint(command)
+	if err != nil {
+		return nil, fmt.Errorf("error enabling fail point %s: %s", name, err)
+	}
+
+	return &FailPoint{server: s, name: name}, nil
+}
+
+// FailCommandOptions configures the failCommand fail point, which makes
+// mongod fail or stall the given commands. failCommand needs MongoDB 4.0 or
+// later; BlockConnection needs 4.2.9 or later.
+type FailCommandOptions struct {
+	// The commands to fail, such as "insert" or "find". Required.
+	Commands []string
+
+	// How many times to fail the commands. If this is 0, they fail until the
+	// fail point is disabled.
+	Times int
+
+	// The error code to fail the commands with, such as
+	// ErrorCodeNotWritablePrimary
+	ErrorCode int
+
+	// Error labels to attach to the error, such as "RetryableWriteError"
+	ErrorLabels []string
+
+	// If true, mongod closes the connection instead of replying, which the
+	// driver sees as a network error
+	CloseConnection bool
+
+	// If non-zero, mongod waits this long before running the command (or
+	// failing it)
+	BlockConnection time.Duration
+
+	// If given, only commands from clients with this appName fail (MongoDB
+	// 4.4 and later)
+	AppName string
+}
+
+// FailCommand enables the failCommand fail point, which makes mongod fail
+// the given commands, for testing how code handles transient errors. See
+// EnableFailPoint for how to enable test commands and disable the fail
+// point.
+func (s *Server) FailCommand(opts FailCommandOptions) (*FailPoint, error) {
+	if len(opts.Commands) == 0 {
+		return nil, errors.New("FailCommandOptions.Commands must not be empty")
+	}
+
+	return s.EnableFailPoint("failCommand", opts.mode(), opts.data())
+}
+
+// mode returns the fail point mode for the failCommand fail point
+func (opts FailCommandOptions) mode() interface{} {
+	if opts.Times > 0 {
+		return FailPointTimes(opts.Times)
+	}
+
+	return FailPointAlwaysOn
+}
+
+// data returns the data for the failCommand fail point
+func (opts FailCommandOptions) data() map[string]interface{} {
+	data := map[string]interface{}{
+		"failCommands": opts.Commands,
+	}
+	if opts.ErrorCode != 0 {
+		data["errorCode"] = opts.ErrorCode
+	}
+	if len(opts.ErrorLabels) > 0 {
+		data["errorLabels"] = opts.ErrorLabels
+	}
+	if opts.CloseConnection {
+		data["closeConnection"] = true
+	}
+	if opts.BlockConnection != 0 {
+		data["blockConnection"] = true
+		data["blockTimeMS"] = opts.BlockConnection.Milliseconds()
+	}
+	if opts.AppName != "" {
+		data["appName"] = opts.AppName
+	}
+
+	return data
+}
+
+// Name returns the name of the fail point
+func (fp *FailPoint) Name() string {
+	return fp.name
+}
+
+// Disable turns the fail point off. It does nothing if the fail point has
+// already been disabled, or if the server has been stopped.
+func (fp *FailPoint) Disable() error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.disabled || fp.server.process() == nil {
+		return nil
+	}
+
+	err := fp.server.configureFailPoint(bson.D{
+		{Key: "configureFailPoint", Value: fp.name},
+		{Key: "mode", Value: "off"},
+	})
+	if err != nil {
+		return fmt.Errorf("error disabling fail point %s: %s", fp.name, err)
+	}
+
+	fp.disabled = true
+	return nil
+}
+
+// configureFailPoint runs a configureFailPoint command
+func (s *Server) configureFailPoint(command bson.D) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.StartupTimeout)
+	defer cancel()
+
+	return s.runAdminCommand(ctx, command, nil)
+}
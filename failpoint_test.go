@@ -0,0 +1,62 @@
+package memongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFailCommandOptions(t *testing.T) {
+	tests := map[string]struct {
+		opts FailCommandOptions
+
+		expectedMode interface{}
+		expectedData map[string]interface{}
+	}{
+		"error code": {
+			opts:         FailCommandOptions{Commands: []string{"insert"}, Times: 2, ErrorCode: ErrorCodeNotWritablePrimary},
+			expectedMode: bson.D{{Key: "times", Value: 2}},
+			expectedData: map[string]interface{}{"failCommands": []string{"insert"}, "errorCode": 10107},
+		},
+		"always": {
+			opts:         FailCommandOptions{Commands: []string{"find"}, ErrorCode: ErrorCodeShutdownInProgress, ErrorLabels: []string{"RetryableWriteError"}},
+			expectedMode: FailPointAlwaysOn,
+			expectedData: map[string]interface{}{"failCommands": []string{"find"}, "errorCode": 91, "errorLabels": []string{"RetryableWriteError"}},
+		},
+		"close connection": {
+			opts:         FailCommandOptions{Commands: []string{"insert", "update"}, Times: 1, CloseConnection: true, AppName: "myapp"},
+			expectedMode: bson.D{{Key: "times", Value: 1}},
+			expectedData: map[string]interface{}{"failCommands": []string{"insert", "update"}, "closeConnection": true, "appName": "myapp"},
+		},
+		"block connection": {
+			opts:         FailCommandOptions{Commands: []string{"find"}, BlockConnection: 2 * time.Second},
+			expectedMode: FailPointAlwaysOn,
+			expectedData: map[string]interface{}{"failCommands": []string{"find"}, "blockConnection": true, "blockTimeMS": int64(2000)},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expectedMode, test.opts.mode())
+			assert.Equal(t, test.expectedData, test.opts.data())
+		})
+	}
+}
+
+func TestFailCommandNoCommands(t *testing.T) {
+	server := &Server{opts: &Options{}}
+
+	_, err := server.FailCommand(FailCommandOptions{ErrorCode: ErrorCodeNotWritablePrimary})
+	require.EqualError(t, err, "FailCommandOptions.Commands must not be empty")
+}
+
+func TestDisableFailPointAfterStop(t *testing.T) {
+	// The server isn't running, so there's nothing to disable
+	fp := &FailPoint{server: &Server{opts: &Options{}}, name: "failCommand"}
+
+	require.NoError(t, fp.Disable())
+	require.NoError(t, fp.Disable())
+}
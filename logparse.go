@@ -0,0 +1,250 @@
+package memongo
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// logEntry is a single line of mongod's log output. MongoDB 4.4 and later log
+// structured JSON, which we parse into the fields below. For earlier versions
+// (or any line that isn't JSON), only Text and, if the line has one,
+// Severity are set.
+type logEntry struct {
+	// The raw log line
+	Text string
+
+	// Whether the line was a structured (JSON) log line
+	Structured bool
+
+	// The fields of a structured log line. See:
+	// https://docs.mongodb.com/manual/reference/log-messages/#structured-logging
+	ID        int
+	Severity  string
+	Component string
+	Context   string
+	Msg       string
+	Attr      map[string]interface{}
+}
+
+// jsonLogLine is the JSON representation of a structured log line
+type jsonLogLine struct {
+	ID        int                    `json:"id"`
+	Severity  string                 `json:"s"`
+	Component string                 `json:"c"`
+	Context   string                 `json:"ctx"`
+	Msg       string                 `json:"msg"`
+	Attr      map[string]interface{} `json:"attr"`
+}
+
+// Well-known structured log message IDs
+const (
+	logIDListening             = 23015
+	logIDWaitingForConnections = 23016
+	logIDListenerError         = 20568
+	logIDBindFailed            = 23024
+	logIDFatalAssertion        = 23089
+	logIDFatalAssertionAbort   = 23090
+	logIDFatalAssertionMsg     = 23091
+	logIDShuttingDown          = 23138
+)
+
+// mongod's exit code when it can't listen on its port
+const exitCodeNetError = 48
+
+// The severities of log lines for fatal and other errors
+const (
+	severityFatal = "F"
+	severityError = "E"
+)
+
+// logEvent is what a log line tells us about the progress of startup
+type logEvent int
+
+const (
+	// The line doesn't tell us anything about startup
+	logEventNone logEvent = iota
+
+	// mongod is ready to accept connections
+	logEventReady
+
+	// mongod could not listen on its port because it's in use
+	logEventPortInUse
+
+	// Another mongod is already using the data directory
+	logEventAlreadyRunning
+
+	// mongod was denied permission to a file or port
+	logEventPermissionDenied
+
+	// The data directory doesn't exist
+	logEventDataDirNotFound
+
+	// mongod hit a fatal error
+	logEventFatal
+
+	// mongod is shutting down
+	logEventShutdown
+)
+
+// Patterns for plain-text log lines (and for the text of errors in structured
+// log lines). These are matched against the lowercased line.
+//
+// Cribbed from https://github.com/nodkz/mongodb-memory-server/blob/master/packages/mongodb-memory-server-core/src/util/MongoInstance.ts#L206
+var reReady = regexp.MustCompile(`waiting for connections on port (\d+)`)
+var reListening = regexp.MustCompile(`listening on (\S+)\s*$`)
+var reAlreadyInUse = regexp.MustCompile("addr(ess)? already in use")
+var reAlreadyRunning = regexp.MustCompile("mongod instance (is )?already running|mongod already running")
+var rePermissionDenied = regexp.MustCompile("permission denied")
+var reDataDirectoryNotFound = regexp.MustCompile("data directory .*? not found")
+var reShuttingDown = regexp.MustCompile("shutting down with code")
+
+// The severity of a plain-text log line, which follows the timestamp.
+// MongoDB 3.0 and later log one; debug lines have a level, like "D1".
+var reTextSeverity = regexp.MustCompile(`^\S+ ([FEWI]|D\d) `)
+
+// parseLogLine parses a line of mongod output, which may be plain text or a
+// structured JSON log line.
+func parseLogLine(line string) logEntry {
+	entry := logEntry{Text: line}
+
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		if match := reTextSeverity.FindStringSubmatch(line); match != nil {
+			entry.Severity = match[1]
+		}
+
+		return entry
+	}
+
+	var parsed jsonLogLine
+	err := json.Unmarshal([]byte(line), &parsed)
+	if err != nil {
+		return entry
+	}
+
+	entry.Structured = true
+	entry.ID = parsed.ID
+	entry.Severity = parsed.Severity
+	entry.Component = parsed.Component
+	entry.Context = parsed.Context
+	entry.Msg = parsed.Msg
+	entry.Attr = parsed.Attr
+
+	return entry
+}
+
+// classify returns what this log line tells us about startup. For
+// logEventReady, it also returns the port mongod is listening on.
+func (e *logEntry) classify() (logEvent, int, error) {
+	if e.Structured {
+		event, port, err := e.classifyStructured()
+		if event != logEventNone || err != nil {
+			return event, port, err
+		}
+	}
+
+	downcaseLine := strings.ToLower(e.Text)
+
+	if !e.Structured {
+		if match := reReady.FindStringSubmatch(downcaseLine); match != nil {
+			port, err := strconv.Atoi(match[1])
+			if err != nil {
+				return logEventNone, 0, fmt.Errorf("could not parse port from mongod log line: %s", e.Text)
+			}
+
+			return logEventReady, port, nil
+		}
+	}
+
+	// Informational lines can mention things like "permission denied" (in a
+	// path, say) without it being a startup failure. Plain-text lines from
+	// before MongoDB 3.0 have no severity, so they're always checked.
+	isError := e.Severity == severityFatal || e.Severity == severityError || e.Severity == ""
+	if e.Structured && !isError {
+		return logEventNone, 0, nil
+	}
+
+	switch {
+	case isError && reAlreadyInUse.MatchString(downcaseLine):
+		return logEventPortInUse, 0, nil
+	case isError && reAlreadyRunning.MatchString(downcaseLine):
+		return logEventAlreadyRunning, 0, nil
+	case isError && rePermissionDenied.MatchString(downcaseLine):
+		return logEventPermissionDenied, 0, nil
+	case reDataDirectoryNotFound.MatchString(downcaseLine):
+		return logEventDataDirNotFound, 0, nil
+	case reShuttingDown.MatchString(downcaseLine):
+		return logEventShutdown, 0, nil
+	case e.Severity == severityFatal:
+		return logEventFatal, 0, nil
+	}
+
+	return logEventNone, 0, nil
+}
+
+// classifyStructured classifies structured log lines by their message ID
+func (e *logEntry) classifyStructured() (logEvent, int, error) {
+	switch e.ID {
+	case logIDWaitingForConnections:
+		port, ok := e.intAttr("port")
+		if !ok {
+			return logEventNone, 0, fmt.Errorf("could not parse port from mongod log line: %s", e.Text)
+		}
+
+		return logEventReady, port, nil
+
+	case logIDBindFailed, logIDListenerError:
+		if rePermissionDenied.MatchString(strings.ToLower(e.Text)) {
+			return logEventPermissionDenied, 0, nil
+		}
+
+		return logEventPortInUse, 0, nil
+
+	case logIDFatalAssertion, logIDFatalAssertionAbort, logIDFatalAssertionMsg:
+		return logEventFatal, 0, nil
+
+	case logIDShuttingDown:
+		exitCode, _ := e.intAttr("exitCode")
+		if exitCode == exitCodeNetError {
+			return logEventPortInUse, 0, nil
+		}
+
+		return logEventShutdown, 0, nil
+	}
+
+	return logEventNone, 0, nil
+}
+
+// listenAddress returns the address mongod is listening on, if this line
+// reports one. mongod logs a line for each address (and socket) it binds to
+// before it logs that it's waiting for connections.
+func (e *logEntry) listenAddress() (string, bool) {
+	if e.Structured {
+		if e.ID != logIDListening {
+			return "", false
+		}
+
+		address, ok := e.Attr["address"].(string)
+		return address, ok
+	}
+
+	match := reListening.FindStringSubmatch(strings.ToLower(e.Text))
+	if match == nil {
+		return "", false
+	}
+
+	return match[1], true
+}
+
+// intAttr returns an integer attribute of a structured log line
+func (e *logEntry) intAttr(name string) (int, bool) {
+	// encoding/json decodes all numbers as float64
+	value, ok := e.Attr[name].(float64)
+	if !ok {
+		return 0, false
+	}
+
+	return int(value), true
+}
@@ -0,0 +1,183 @@
+package memongo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLine(t *testing.T) {
+	entry := parseLogLine(`{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"NETWORK",  "id":23016,   "ctx":"listener","msg":"Waiting for connections","attr":{"port":27017,"ssl":"off"}}`)
+
+	assert.True(t, entry.Structured)
+	assert.Equal(t, 23016, entry.ID)
+	assert.Equal(t, "I", entry.Severity)
+	assert.Equal(t, "NETWORK", entry.Component)
+	assert.Equal(t, "listener", entry.Context)
+	assert.Equal(t, "Waiting for connections", entry.Msg)
+	assert.Equal(t, map[string]interface{}{"port": float64(27017), "ssl": "off"}, entry.Attr)
+
+	entry = parseLogLine("2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] waiting for connections on port 27017")
+	assert.False(t, entry.Structured)
+	assert.Equal(t, "2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] waiting for connections on port 27017", entry.Text)
+	assert.Equal(t, "I", entry.Severity)
+
+	entry = parseLogLine("{ this is not json")
+	assert.False(t, entry.Structured)
+}
+
+func TestClassifyLogLine(t *testing.T) {
+	tests := map[string]struct {
+		line string
+
+		expectedEvent logEvent
+		expectedPort  int
+		expectedError string
+	}{
+		"text ready": {
+			line:          "2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] waiting for connections on port 12345",
+			expectedEvent: logEventReady,
+			expectedPort:  12345,
+		},
+		"text address in use": {
+			line:          "2019-11-05T12:00:00.000+0000 E STORAGE  [initandlisten] Failed to set up listener: SocketException: Address already in use",
+			expectedEvent: logEventPortInUse,
+		},
+		"text already running": {
+			line:          "2019-11-05T12:00:00.000+0000 E STORAGE  [initandlisten] exception in initAndListen: DBPathInUse: Unable to lock the lock file: /tmp/db/mongod.lock (Resource temporarily unavailable). Another mongod instance is already running on the /tmp/db directory, terminating",
+			expectedEvent: logEventAlreadyRunning,
+		},
+		"text already running question": {
+			line:          "2019-11-05T12:00:00.000+0000 E STORAGE  [initandlisten] exception in initAndListen: DBPathInUse: Unable to lock the lock file: /tmp/db/mongod.lock (Resource temporarily unavailable). Is a mongod instance already running on the /tmp/db directory?, terminating",
+			expectedEvent: logEventAlreadyRunning,
+		},
+		"text data directory not found": {
+			line:          "2019-11-05T12:00:00.000+0000 I STORAGE  [initandlisten] exception in initAndListen: NonExistentPath: Data directory /tmp/nope not found., terminating",
+			expectedEvent: logEventDataDirNotFound,
+		},
+		"text shutting down": {
+			line:          "2019-11-05T12:00:00.000+0000 I CONTROL  [initandlisten] shutting down with code:100",
+			expectedEvent: logEventShutdown,
+		},
+		"text other": {
+			line:          "2019-11-05T12:00:00.000+0000 I CONTROL  [initandlisten] MongoDB starting : pid=1234 port=12345",
+			expectedEvent: logEventNone,
+		},
+		"text info mentioning an error": {
+			line:          "2019-11-05T12:00:00.000+0000 I CONTROL  [initandlisten] options: { storage: { dbPath: \"/tmp/permission denied\" } }",
+			expectedEvent: logEventNone,
+		},
+		"text without severity": {
+			line:          "Tue Nov  5 12:00:00.000 [initandlisten] ERROR: listen(): bind() failed errno:98 Address already in use for socket: 0.0.0.0:12345",
+			expectedEvent: logEventPortInUse,
+		},
+		"json ready": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"NETWORK",  "id":23016,   "ctx":"listener","msg":"Waiting for connections","attr":{"port":12345,"ssl":"off"}}`,
+			expectedEvent: logEventReady,
+			expectedPort:  12345,
+		},
+		"json ready without port": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"NETWORK",  "id":23016,   "ctx":"listener","msg":"Waiting for connections","attr":{}}`,
+			expectedError: `could not parse port from mongod log line: {"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"NETWORK",  "id":23016,   "ctx":"listener","msg":"Waiting for connections","attr":{}}`,
+		},
+		"json bind failed": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"E",  "c":"NETWORK",  "id":23024,   "ctx":"initandlisten","msg":"Listen(): bind() failed","attr":{"error":"Address already in use","bindAddress":"127.0.0.1"}}`,
+			expectedEvent: logEventPortInUse,
+		},
+		"json bind permission denied": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"E",  "c":"NETWORK",  "id":23024,   "ctx":"initandlisten","msg":"Listen(): bind() failed","attr":{"error":"Permission denied","bindAddress":"127.0.0.1"}}`,
+			expectedEvent: logEventPermissionDenied,
+		},
+		"json shutdown with net error": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"CONTROL",  "id":23138,   "ctx":"initandlisten","msg":"Shutting down","attr":{"exitCode":48}}`,
+			expectedEvent: logEventPortInUse,
+		},
+		"json shutdown": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"CONTROL",  "id":23138,   "ctx":"initandlisten","msg":"Shutting down","attr":{"exitCode":100}}`,
+			expectedEvent: logEventShutdown,
+		},
+		"json fatal assertion": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"F",  "c":"-",        "id":23089,   "ctx":"initandlisten","msg":"Fatal assertion","attr":{"msgid":28595,"file":"src/mongo/db/storage/wiredtiger/wiredtiger_kv_engine.cpp","line":1123}}`,
+			expectedEvent: logEventFatal,
+		},
+		"json unknown fatal": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"F",  "c":"CONTROL",  "id":99999,   "ctx":"initandlisten","msg":"Something terrible"}`,
+			expectedEvent: logEventFatal,
+		},
+		"json error with permission denied": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"E",  "c":"STORAGE",  "id":20557,   "ctx":"initandlisten","msg":"DBException in initAndListen, terminating","attr":{"error":"Location28596: Unable to determine status of lock file in the data directory /tmp/db: boost::filesystem::status: Permission denied: \"/tmp/db/mongod.lock\""}}`,
+			expectedEvent: logEventPermissionDenied,
+		},
+		"json error with already running": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"E",  "c":"STORAGE",  "id":20557,   "ctx":"initandlisten","msg":"DBException in initAndListen, terminating","attr":{"error":"DBPathInUse: Unable to lock the lock file: /tmp/db/mongod.lock (Resource temporarily unavailable). Another mongod instance is already running on the /tmp/db directory"}}`,
+			expectedEvent: logEventAlreadyRunning,
+		},
+		"json info mentioning an error": {
+			line:          `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"CONTROL",  "id":21951,   "ctx":"initandlisten","msg":"Options set by command line","attr":{"options":{"storage":{"dbPath":"/tmp/permission denied"}}}}`,
+			expectedEvent: logEventNone,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			entry := parseLogLine(test.line)
+			event, port, err := entry.classify()
+
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedEvent, event)
+			assert.Equal(t, test.expectedPort, port)
+		})
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := map[string]struct {
+		line string
+
+		expectedAddress string
+		expectedOK      bool
+	}{
+		"text IPv4": {
+			line:            "2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] Listening on 127.0.0.1",
+			expectedAddress: "127.0.0.1",
+			expectedOK:      true,
+		},
+		"text IPv6": {
+			line:            "2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] Listening on ::1",
+			expectedAddress: "::1",
+			expectedOK:      true,
+		},
+		"text socket": {
+			line:            "2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] Listening on /tmp/mongodb-27017.sock",
+			expectedAddress: "/tmp/mongodb-27017.sock",
+			expectedOK:      true,
+		},
+		"text other": {
+			line: "2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] waiting for connections on port 27017",
+		},
+		"json": {
+			line:            `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"NETWORK",  "id":23015,   "ctx":"listener","msg":"Listening on","attr":{"address":"::1"}}`,
+			expectedAddress: "::1",
+			expectedOK:      true,
+		},
+		"json other": {
+			line: `{"t":{"$date":"2020-08-05T12:00:00.000+00:00"},"s":"I",  "c":"NETWORK",  "id":23016,   "ctx":"listener","msg":"Waiting for connections","attr":{"port":12345,"ssl":"off"}}`,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			entry := parseLogLine(test.line)
+
+			address, ok := entry.listenAddress()
+			assert.Equal(t, test.expectedOK, ok)
+			assert.Equal(t, test.expectedAddress, address)
+		})
+	}
+}
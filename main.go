@@ -2,28 +2,110 @@ package memongo
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/benweissmann/memongo/memongolog"
 	"github.com/benweissmann/memongo/monitor"
+	"github.com/benweissmann/memongo/proxy"
 )
 
 // Server represents a running MongoDB server
 type Server struct {
-	cmd        *exec.Cmd
-	watcherCmd *exec.Cmd
-	dbDir      string
-	logger     *memongolog.Logger
-	port       int
+	opts    *Options
+	binPath string
+	cmd     *exec.Cmd
+	watcher *monitor.Watcher
+	dbDir   string
+	logger  *memongolog.Logger
+	port    int
+
+	// exited is closed when the current mongod process exits, at which point
+	// exitErr holds the result of cmd.Wait()
+	exited  chan struct{}
+	exitErr error
+
+	// The last lines of output from the current mongod process
+	output *logTail
+
+	// Whether the port is fixed, either because it was given to us or because
+	// the server has already run on it. If not, we can retry on a different
+	// port if the port is in use.
+	fixedPort bool
+
+	// The name of the replica set this server is a member of, or "" if it's
+	// a standalone server
+	replicaSetName string
+
+	// Extra arguments for the server's role in a sharded cluster
+	// (e.g. --configsvr)
+	roleArgs []string
+
+	// For mongos routers, the connection string for the config server
+	// replica set. This is "" for mongod servers.
+	configDB string
+
+	// The credentials of the admin user, once it's been created. These are ""
+	// unless the server was started with Options.Auth.
+	username string
+	password string
+
+	// The generated CA and certificates, if the server was started with
+	// Options.TLS
+	tls *tlsFiles
+
+	// The host to connect to, based on the addresses mongod reported it's
+	// listening on. This is "" if mongod didn't report any.
+	boundHost string
+
+	// The path to the generated config file, if Options.Config was given
+	configFile string
+
+	// The path to the generated keyfile, if the server is a replica set
+	// member with Options.Auth
+	keyFile string
+
+	// The fault-injecting proxy in front of the server, if Options.Proxy is
+	// true
+	proxy *proxy.Proxy
+
+	// Whether the mongod process has been stopped with SIGSTOP by Pause
+	paused bool
+
+	// Waits for mongod to answer commands once it's listening. This is a
+	// pingProbe; tests replace it to start fake mongods.
+	readyProbe readinessProbe
+
+	// mu guards the fields that change when mongod is started or restarted
+	// (cmd, exited, port, boundHost, username, password, and paused), so
+	// they can be read while a restart is in progress, as well as running
+	// and crashErr, which are shared with the goroutine that reaps mongod.
+	// The fields are only changed with restartMu held (or before the Server
+	// is returned), so code holding restartMu can read them without mu.
+	//
+	// running is true between mongod starting up and memongo stopping it; if
+	// mongod exits while it's true, it crashed, and crashErr describes how.
+	mu       sync.Mutex
+	running  bool
+	crashErr *CrashError
+
+	// For Options.Restart: restartMu is held while mongod is being restarted
+	// after a crash (and by anything else that starts or stops it), and
+	// restartCtx is cancelled by StopContext to give up on restarting.
+	restartMu     sync.Mutex
+	restartCtx    context.Context
+	cancelRestart context.CancelFunc
 }
 
 // Start runs a MongoDB server at a given MongoDB version using default options
@@ -36,6 +118,13 @@ func Start(version string) (*Server, error) {
 
 // StartWithOptions is like Start(), but accepts options.
 func StartWithOptions(opts *Options) (*Server, error) {
+	return StartContext(context.Background(), opts)
+}
+
+// StartContext is like StartWithOptions, but gives up when ctx is done. This
+// cancels downloading mongod and waiting for it to start up; the data
+// directory and any processes started so far are cleaned up.
+func StartContext(ctx context.Context, opts *Options) (*Server, error) {
 	err := opts.fillDefaults()
 	if err != nil {
 		return nil, err
@@ -45,203 +134,667 @@ func StartWithOptions(opts *Options) (*Server, error) {
 
 	logger.Infof("Starting MongoDB with options %#v", opts)
 
-	binPath, err := opts.getOrDownloadBinPath()
+	sweepOnStart(opts, logger)
+
+	binPath, err := opts.getOrDownloadBinPath(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	logger.Debugf("Using binary %s", binPath)
 
+	err = opts.fillVersionDefaults(ctx, binPath)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := newServer(opts, binPath, opts.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	startupTime := time.Now()
+
+	err = server.launch(ctx)
+	if err != nil {
+		_ = server.removeDBDir()
+		return nil, err
+	}
+
+	if opts.ReplicaSet {
+		logger.Debugf("Initiating replica set %s", opts.ReplicaSetName)
+
+		initCtx, cancel := context.WithTimeout(ctx, opts.StartupTimeout)
+		defer cancel()
+
+		err := initiateReplicaSet(initCtx, opts.ReplicaSetName, []*Server{server})
+		if err != nil {
+			server.Stop()
+			return nil, err
+		}
+
+		logger.Debugf("Replica set %s has a primary after %s", opts.ReplicaSetName, time.Since(startupTime).String())
+	}
+
+	if opts.Auth {
+		logger.Debugf("Creating admin user")
+
+		authCtx, cancel := context.WithTimeout(ctx, opts.StartupTimeout)
+		defer cancel()
+
+		err := server.createAdminUser(authCtx)
+		if err != nil {
+			server.Stop()
+			return nil, err
+		}
+	}
+
+	if opts.Proxy {
+		err := server.startProxy()
+		if err != nil {
+			server.Stop()
+			return nil, err
+		}
+	}
+
+	// Return a Memongo server
+	return server, nil
+}
+
+// newServer creates a Server with a fresh data directory, but does not start
+// it.
+func newServer(opts *Options, binPath string, port int) (*Server, error) {
 	// Create a db dir. Even the ephemeralForTest engine needs a dbpath.
-	dbDir, err := ioutil.TempDir("", "")
+	dbDir, err := ioutil.TempDir(opts.dbDirRoot(), dbDirPrefix)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.DisableTCP && port == 0 {
+		port = disabledTCPPort
+	}
+
+	server := &Server{
+		opts:       opts,
+		binPath:    binPath,
+		dbDir:      dbDir,
+		logger:     opts.getLogger(),
+		port:       port,
+		fixedPort:  port != 0,
+		readyProbe: &pingProbe{},
+	}
+	server.restartCtx, server.cancelRestart = context.WithCancel(context.Background())
+
+	err = server.checkSocketPath()
+	if err != nil {
+		_ = server.removeDBDir()
+		return nil, err
+	}
+
+	if opts.ReplicaSet {
+		server.replicaSetName = opts.ReplicaSetName
+	}
+
+	if opts.Auth && server.replicaSetName != "" {
+		server.keyFile, err = writeKeyFile(dbDir)
+		if err != nil {
+			_ = server.removeDBDir()
+			return nil, err
+		}
+	}
+
+	if opts.TLS {
+		server.tls, err = generateTLSFiles(dbDir, opts.TLSClientCertificate)
+		if err != nil {
+			_ = server.removeDBDir()
+			return nil, err
+		}
+	}
+
+	if opts.Config != nil {
+		server.configFile, err = opts.writeConfigFile(dbDir)
+		if err != nil {
+			_ = server.removeDBDir()
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
+
+// launch starts the mongod process and its watcher, and waits for mongod to
+// report the port it's listening on. If the server has run before, it's
+// started on the same port with the same data directory. On error, any
+// started processes are killed, but the data directory is left in place.
+//
+// launch gives up when ctx is done or after the startup timeout, whichever is
+// first.
+//
+// If we picked the port and it turns out to be in use (because another
+// process grabbed it between us checking it and mongod binding to it), launch
+// retries on a new port, up to Options.MaxPortRetries times.
+func (s *Server) launch(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		err := s.launchOnce(ctx)
+		if err == nil {
+			s.fixedPort = true
+			return nil
+		}
+
+		if s.fixedPort || attempt >= s.opts.MaxPortRetries || !errors.Is(err, ErrPortInUse) {
+			return err
+		}
+
+		s.logger.Infof("Port %d is already in use; retrying on a new port", s.port)
+		s.setPort(0)
+	}
+}
+
+// launchOnce makes a single attempt to start mongod
+func (s *Server) launchOnce(ctx context.Context) error {
+	logger := s.logger
+
+	if s.port == 0 && s.opts.needsExplicitPort() {
+		port, err := s.opts.pickFreePort()
+		if err != nil {
+			return fmt.Errorf("error finding a free port: %s", err)
+		}
+
+		s.setPort(port)
+	}
+
 	// Construct the command and attach stdout/stderr handlers
 
 	//  Safe to pass binPath and dbDir
 	//nolint:gosec
-	cmd := exec.Command(binPath, "--storageEngine", "ephemeralForTest", "--dbpath", dbDir, "--port", strconv.Itoa(opts.Port))
+	cmd := exec.Command(s.binPath, s.args()...)
+
+	// We don't set Pdeathsig: Linux sends it when the OS thread that started
+	// mongod exits, not when this process does, and Go doesn't promise that
+	// thread lives as long as we do (golang/go#27505). The watcher handles
+	// our exit instead.
 
-	stdoutHandler, startupErrCh, startupPortCh := stdoutHandler(logger)
-	cmd.Stdout = stdoutHandler
-	cmd.Stderr = stderrHandler(logger)
+	s.output = newLogTail(startupErrorLogLines)
+
+	var handlersDone sync.WaitGroup
+	stdoutWriter, startupErrCh, startupReadyCh := stdoutHandler(logger, s.output, &handlersDone)
+	stderrWriter := stderrHandler(logger, s.output, &handlersDone)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
 
 	logger.Debugf("Starting mongod")
 
 	// Run the server
-	err = cmd.Start()
+	err := cmd.Start()
 	if err != nil {
-		remErr := os.RemoveAll(dbDir)
-		if remErr != nil {
-			logger.Warnf("error removing data directory: %s", remErr)
-		}
-
-		return nil, err
+		_ = stdoutWriter.Close()
+		_ = stderrWriter.Close()
+		return err
 	}
 
+	// Reap the process when it exits, so it doesn't linger as a zombie. Once
+	// Wait returns, all output has been copied to the handlers, so we close
+	// them and wait for them to finish processing it.
+	// If mongod was running, it crashed, and we report that once Done() is
+	// closed.
+	exited := make(chan struct{})
+	s.mu.Lock()
+	s.cmd = cmd
+	s.exited = exited
+	s.mu.Unlock()
+	go func() {
+		s.exitErr = cmd.Wait()
+		_ = stdoutWriter.Close()
+		_ = stderrWriter.Close()
+		handlersDone.Wait()
+
+		crashErr := s.recordExit()
+		close(exited)
+
+		if crashErr != nil {
+			if s.opts.OnCrash != nil {
+				s.opts.OnCrash(crashErr)
+			}
+
+			s.restartAfterCrash()
+		}
+	}()
+
 	logger.Debugf("Started mongod; starting watcher")
 
 	// Start a watcher: the watcher is a subprocess that ensure if this process
-	// dies, the mongo server will be killed (and not reparented under init)
-	watcherCmd, err := monitor.RunMonitor(os.Getpid(), cmd.Process.Pid)
+	// dies, the mongo server will be killed (and not reparented under init),
+	// and its data directory removed
+	watcher, err := monitor.Start(cmd.Process.Pid, s.dbDir)
 	if err != nil {
-		killErr := cmd.Process.Kill()
+		killErr := s.kill()
 		if killErr != nil {
 			logger.Warnf("error stopping mongo process: %s", killErr)
 		}
 
-		remErr := os.RemoveAll(dbDir)
-		if remErr != nil {
-			logger.Warnf("error removing data directory: %s", remErr)
-		}
-
-		return nil, err
+		return err
 	}
 
-	logger.Debugf("Started watcher; waiting for mongod to report port number")
-	startupTime := time.Now()
+	s.watcher = watcher
 
-	// Wait for the stdout handler to report the server's port number (or a
-	// startup error)
-	var port int
-	select {
-	case p := <-startupPortCh:
-		port = p
-	case err := <-startupErrCh:
-		killErr := cmd.Process.Kill()
-		if killErr != nil {
-			logger.Warnf("error stopping mongo process: %s", killErr)
+	// Record who owns mongod, so Sweep can clean up after us if both we and
+	// the watcher are killed
+	s.writeStateOrWarn()
+
+	logger.Debugf("Started watcher; waiting for mongod to start up")
+
+	startupCtx, cancel := context.WithTimeout(ctx, s.opts.StartupTimeout)
+	defer cancel()
+
+	// First wait for the stdout handler to report the server's port number
+	// (or a startup error), then wait for the server to answer commands.
+	err = s.waitForStartup(startupCtx, []readinessProbe{
+		&logPortProbe{readyCh: startupReadyCh, errCh: startupErrCh},
+		s.readyProbe,
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			// We were cancelled; there's nothing to debug
+			s.killAfterFailedStart()
+			return err
 		}
 
-		remErr := os.RemoveAll(dbDir)
-		if remErr != nil {
-			logger.Warnf("error removing data directory: %s", remErr)
+		// If mongod reported an error, it's probably about to exit; give it
+		// a moment so we can report its exit code
+		if !errors.Is(err, ErrStartupTimeout) {
+			select {
+			case <-s.exited:
+			case <-time.After(exitGracePeriod):
+			}
 		}
 
-		return nil, err
-	case <-time.After(opts.StartupTimeout):
-		killErr := cmd.Process.Kill()
-		if killErr != nil {
-			logger.Warnf("error stopping mongo process: %s", killErr)
+		s.killAfterFailedStart()
+		return s.newStartupError(err)
+	}
+
+	// Now that we know the port, record it too
+	s.writeStateOrWarn()
+	s.setRunning(true)
+
+	return nil
+}
+
+// How long to wait for mongod to exit on its own after it reports a startup
+// error
+const exitGracePeriod = 2 * time.Second
+
+// newStartupError wraps an error from waitForStartup in a *StartupError, with
+// the command line, exit status, and recent output of the (reaped) mongod
+// process.
+func (s *Server) newStartupError(err error) error {
+	var startupErr *StartupError
+	if !errors.As(err, &startupErr) {
+		startupErr = &StartupError{Err: err}
+	}
+
+	startupErr.Command = append([]string{s.binPath}, s.args()...)
+	startupErr.ExitCode, startupErr.Signal = exitStatus(s.exitErr)
+	startupErr.LogTail = s.output.snapshot()
+
+	return startupErr
+}
+
+// args returns the command-line arguments to mongod (or mongos)
+func (s *Server) args() []string {
+	if s.configDB != "" {
+		return []string{"--configdb", s.configDB, "--port", strconv.Itoa(s.port)}
+	}
+
+	args := append(s.opts.storageEngineArgs(), "--dbpath", s.dbDir, "--port", strconv.Itoa(s.port))
+	if s.replicaSetName != "" {
+		args = append(args, "--replSet", s.replicaSetName)
+	}
+	if s.opts.Auth {
+		args = append(args, "--auth")
+	}
+	if s.keyFile != "" {
+		args = append(args, "--keyFile", s.keyFile)
+	}
+	if s.tls != nil {
+		args = append(args, s.tlsArgs()...)
+	}
+	args = append(args, s.bindArgs()...)
+	args = append(args, s.roleArgs...)
+
+	return append(args, s.extraArgs()...)
+}
+
+// kill kills the mongod process with SIGKILL and stops its watcher, leaving
+// the data directory in place.
+func (s *Server) kill() error {
+	if s.cmd == nil {
+		return nil
+	}
+
+	s.setRunning(false)
+
+	var errs multiError
+
+	err := s.cmd.Process.Kill()
+	if err != nil && !s.hasExited() {
+		errs.add(fmt.Errorf("error killing mongod process: %s", err))
+	}
+
+	<-s.exited
+
+	errs.add(s.stopWatcher())
+	s.clearProcess()
+
+	return errs.errOrNil()
+}
+
+// killAfterFailedStart kills the server, logging any errors, after it failed
+// to start up.
+func (s *Server) killAfterFailedStart() {
+	err := s.kill()
+	if err != nil {
+		s.logger.Warnf("error stopping mongo process: %s", err)
+	}
+}
+
+// shutdown asks mongod to shut down cleanly with SIGTERM and waits for it to
+// exit. If it hasn't exited by the time ctx is done, it's killed with
+// SIGKILL. Either way, the watcher is stopped and the data directory is left
+// in place.
+func (s *Server) shutdown(ctx context.Context) error {
+	if s.cmd == nil {
+		return nil
+	}
+
+	s.setRunning(false)
+
+	var errs multiError
+
+	if s.hasExited() {
+		if s.exitErr != nil {
+			errs.add(fmt.Errorf("mongod had already exited: %s", s.exitErr))
+		}
+	} else {
+		err := s.cmd.Process.Signal(syscall.SIGTERM)
+		if err != nil && !s.hasExited() {
+			errs.add(fmt.Errorf("error sending SIGTERM to mongod: %s", err))
 		}
 
-		remErr := os.RemoveAll(dbDir)
-		if remErr != nil {
-			logger.Warnf("error removing data directory: %s", remErr)
+		// A paused mongod can't handle SIGTERM until it's resumed
+		errs.add(s.resume())
+
+		select {
+		case <-s.exited:
+			if s.exitErr != nil {
+				errs.add(fmt.Errorf("mongod did not shut down cleanly: %s", s.exitErr))
+			}
+		case <-ctx.Done():
+			errs.add(fmt.Errorf("mongod did not shut down in time, killing it: %s", ctx.Err()))
+
+			err := s.cmd.Process.Kill()
+			if err != nil && !s.hasExited() {
+				errs.add(fmt.Errorf("error killing mongod process: %s", err))
+			}
+
+			<-s.exited
 		}
+	}
+
+	errs.add(s.stopWatcher())
+	s.clearProcess()
 
-		return nil, errors.New("timed out waiting for mongod to start")
+	return errs.errOrNil()
+}
+
+// hasExited returns true if the current mongod process has exited
+func (s *Server) hasExited() bool {
+	select {
+	case <-s.exited:
+		return true
+	default:
+		return false
 	}
+}
 
-	logger.Debugf("mongod started up and reported a port number after %s", time.Since(startupTime).String())
+// stopWatcher kills and reaps the watcher process
+func (s *Server) stopWatcher() error {
+	if s.watcher == nil {
+		return nil
+	}
 
-	// Return a Memongo server
-	return &Server{
-		cmd:        cmd,
-		watcherCmd: watcherCmd,
-		dbDir:      dbDir,
-		logger:     logger,
-		port:       port,
-	}, nil
+	watcher := s.watcher
+	s.watcher = nil
+
+	return watcher.Stop()
 }
 
-// Port returns the port the server is listening on.
+func (s *Server) removeDBDir() error {
+	err := os.RemoveAll(s.dbDir)
+	if err != nil {
+		return fmt.Errorf("error removing data directory: %s", err)
+	}
+
+	return nil
+}
+
+// Port returns the port the server is listening on, or 0 if it was started
+// with Options.DisableTCP.
 func (s *Server) Port() int {
-	return s.port
+	if s.opts.DisableTCP {
+		return 0
+	}
+
+	_, port := s.address()
+	return port
 }
 
-// URI returns a mongodb:// URI to connect to
+// address returns the host mongod reported it's listening on (or "") and its
+// port
+func (s *Server) address() (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.boundHost, s.port
+}
+
+// setAddress records the host and port mongod reported it's listening on
+func (s *Server) setAddress(boundHost string, port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.boundHost = boundHost
+	s.port = port
+}
+
+// setPort sets the port to start mongod on
+func (s *Server) setPort(port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.port = port
+}
+
+// process returns the current mongod process, or nil if it isn't running
+func (s *Server) process() *exec.Cmd {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cmd
+}
+
+// clearProcess records that mongod has been stopped
+func (s *Server) clearProcess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cmd = nil
+}
+
+// URI returns a mongodb:// URI to connect to. If the server was started with
+// Options.DisableTCP, the URI connects over the Unix domain socket. If the
+// server is a replica set member, the URI includes the replicaSet option. If
+// the server was started with Options.Auth, the URI includes the admin user's
+// credentials, and if it was started with Options.TLS, the URI includes
+// tls=true (connect with TLSConfig() so the driver trusts the server's
+// certificate).
 func (s *Server) URI() string {
-	return fmt.Sprintf("mongodb://localhost:%d", s.port)
+	return s.buildURI("")
 }
 
 // URIWithRandomDB returns a mongodb:// URI to connect to, with
 // a random database name (e.g. mongodb://localhost:1234/somerandomname)
 func (s *Server) URIWithRandomDB() string {
-	return fmt.Sprintf("mongodb://localhost:%d/%s", s.port, RandomDatabase())
+	return s.buildURI(RandomDatabase())
 }
 
-// Stop kills the mongo server
-func (s *Server) Stop() {
-	err := s.cmd.Process.Kill()
-	if err != nil {
-		s.logger.Warnf("error stopping mongod process: %s", err)
-		return
+// ReplicaSetName returns the name of the replica set this server is a member
+// of, or "" if it is a standalone server.
+func (s *Server) ReplicaSetName() string {
+	return s.replicaSetName
+}
+
+func (s *Server) buildURI(db string) string {
+	username, password := s.credentials()
+	return s.buildUserURI(s.host(), db, username, password, s.authSource())
+}
+
+// buildUserURI builds a URI for the given host that authenticates as the
+// given user against the given auth database, or that doesn't authenticate
+// if username is "".
+func (s *Server) buildUserURI(host string, db string, username string, password string, source string) string {
+	query := url.Values{}
+	if s.replicaSetName != "" {
+		query.Set("replicaSet", s.replicaSetName)
 	}
 
-	err = s.watcherCmd.Process.Kill()
-	if err != nil {
-		s.logger.Warnf("error stopping watcher process: %s", err)
-		return
+	if s.tls != nil {
+		query.Set("tls", "true")
+	}
+
+	// With x509, the driver works out the username from the client
+	// certificate, so the URI works for any user's certificate
+	userInfo := ""
+	if username != "" {
+		query.Set("authSource", source)
+		query.Set("authMechanism", s.opts.AuthMechanism)
+		if password != "" {
+			userInfo = url.UserPassword(username, password).String() + "@"
+		}
+	}
+
+	uri := fmt.Sprintf("mongodb://%s%s", userInfo, host)
+	if db != "" || len(query) > 0 {
+		uri += "/" + db
+	}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
 	}
 
-	err = os.RemoveAll(s.dbDir)
+	return uri
+}
+
+// How long Stop() waits for mongod to shut down cleanly before killing it
+const defaultStopTimeout = 15 * time.Second
+
+// Stop shuts down the mongo server and removes its data directory. Errors are
+// logged rather than returned; use StopContext to handle them.
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStopTimeout)
+	defer cancel()
+
+	err := s.StopContext(ctx)
 	if err != nil {
-		s.logger.Warnf("error removing data directory: %s", err)
-		return
+		s.logger.Warnf("error stopping mongod: %s", err)
 	}
 }
 
-// Cribbed from https://github.com/nodkz/mongodb-memory-server/blob/master/packages/mongodb-memory-server-core/src/util/MongoInstance.ts#L206
-var reReady = regexp.MustCompile(`waiting for connections on port (\d+)`)
-var reAlreadyInUse = regexp.MustCompile("addr already in use")
-var reAlreadyRunning = regexp.MustCompile("mongod already running")
-var rePermissionDenied = regexp.MustCompile("mongod permission denied")
-var reDataDirectoryNotFound = regexp.MustCompile("data directory .*? not found")
-var reShuttingDown = regexp.MustCompile("shutting down with code")
+// StopContext asks mongod to shut down cleanly (with SIGTERM) and waits for it
+// to exit. If it hasn't exited by the time ctx is done, it's killed with
+// SIGKILL. It then stops the watcher process and removes the data directory.
+//
+// Every step is attempted even if an earlier one fails. The returned error
+// describes everything that went wrong, so test suites can detect an unclean
+// teardown.
+func (s *Server) StopContext(ctx context.Context) error {
+	// Give up on restarting mongod, and wait for any restart in progress to
+	// finish
+	s.cancelRestart()
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	var errs multiError
+
+	errs.add(s.stopProxy())
+	errs.add(s.shutdown(ctx))
+	errs.add(s.removeDBDir())
+
+	return errs.errOrNil()
+}
+
+// The errors reported by stdoutHandler for each startup failure
+var logEventErrors = map[logEvent]error{
+	logEventPortInUse:        ErrPortInUse,
+	logEventAlreadyRunning:   ErrAlreadyRunning,
+	logEventPermissionDenied: ErrPermissionDenied,
+	logEventDataDirNotFound:  ErrDataDirNotFound,
+	logEventFatal:            ErrFatalError,
+	logEventShutdown:         ErrServerShutDown,
+}
 
-// The stdout handler relays lines from mongod's stout to our logger, and also
-// watches during startup for error or success messages.
+// The stdout handler relays lines from mongod's stout to our logger and the
+// log tail, and also watches during startup for error or success messages.
 //
-// It returns two channels: an error channel and a port channel. Only one
-// message will be sent to one of these two channels. A port number will
-// be sent to the port channel if the server start up correctly, and an
-// error will be send to the error channel if the server does not start up
-// correctly.
-func stdoutHandler(log *memongolog.Logger) (io.Writer, <-chan error, <-chan int) {
-	errChan := make(chan error)
-	portChan := make(chan int)
+// It returns two channels: an error channel and a ready channel. Only one
+// message will be sent to one of these two channels. The port and addresses
+// the server is listening on will be sent to the ready channel if the server
+// start up correctly, and a *StartupError will be send to the error channel
+// if the server does not start up correctly.
+//
+// The handler's goroutine is added to wg, and finishes when the returned
+// writer is closed.
+func stdoutHandler(log *memongolog.Logger, tail *logTail, wg *sync.WaitGroup) (io.WriteCloser, <-chan error, <-chan listenInfo) {
+	// These are buffered so the handler never blocks if launch() has given up
+	// waiting
+	errChan := make(chan error, 1)
+	readyChan := make(chan listenInfo, 1)
 
 	reader, writer := io.Pipe()
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
+
 		scanner := bufio.NewScanner(reader)
 		haveSentMessage := false
+		var addresses []string
 
 		for scanner.Scan() {
 			line := scanner.Text()
 
 			log.Debugf("[Mongod stdout] %s", line)
+			tail.add(line)
 
 			if !haveSentMessage {
-				downcaseLine := strings.ToLower(line)
-
-				if match := reReady.FindStringSubmatch(downcaseLine); match != nil {
-					port, err := strconv.Atoi(match[1])
-					if err != nil {
-						errChan <- errors.New("Could not parse port from mongod log line: " + downcaseLine)
-					} else {
-						portChan <- port
-					}
-					haveSentMessage = true
-				} else if reAlreadyInUse.MatchString(downcaseLine) {
-					errChan <- errors.New("Mongod startup failed, address in use")
-					haveSentMessage = true
-				} else if reAlreadyRunning.MatchString(downcaseLine) {
-					errChan <- errors.New("Mongod startup failed, already running")
-					haveSentMessage = true
-				} else if rePermissionDenied.MatchString(downcaseLine) {
-					errChan <- errors.New("mongod startup failed, permission denied")
-					haveSentMessage = true
-				} else if reDataDirectoryNotFound.MatchString(downcaseLine) {
-					errChan <- errors.New("Mongod startup failed, data directory not found")
-					haveSentMessage = true
-				} else if reShuttingDown.MatchString(downcaseLine) {
-					errChan <- errors.New("Mongod startup failed, server shut down")
+				entry := parseLogLine(line)
+
+				if address, ok := entry.listenAddress(); ok && !strings.Contains(address, "/") {
+					addresses = append(addresses, address)
+				}
+
+				event, port, err := entry.classify()
+				if err != nil {
+					errChan <- &StartupError{Err: err, LogLine: line}
 					haveSentMessage = true
+					continue
 				}
+
+				if event == logEventReady {
+					readyChan <- listenInfo{port: port, addresses: addresses}
+				} else if eventErr, ok := logEventErrors[event]; ok {
+					errChan <- &StartupError{Err: eventErr, LogLine: line}
+				}
+
+				haveSentMessage = event != logEventNone
 			}
 		}
 
@@ -250,22 +803,29 @@ func stdoutHandler(log *memongolog.Logger) (io.Writer, <-chan error, <-chan int)
 		}
 
 		if !haveSentMessage {
-			errChan <- errors.New("Mongod exited before startup completed")
+			errChan <- &StartupError{Err: ErrExitedEarly}
 		}
 	}()
 
-	return writer, errChan, portChan
+	return writer, errChan, readyChan
 }
 
-// The stderr handler just relays messages from stderr to our logger
-func stderrHandler(log *memongolog.Logger) io.Writer {
+// The stderr handler just relays messages from stderr to our logger and the
+// log tail
+func stderrHandler(log *memongolog.Logger, tail *logTail, wg *sync.WaitGroup) io.WriteCloser {
 	reader, writer := io.Pipe()
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
+
 		scanner := bufio.NewScanner(reader)
 
 		for scanner.Scan() {
-			log.Debugf("[Mongod stderr] %s", scanner.Text())
+			line := scanner.Text()
+
+			log.Debugf("[Mongod stderr] %s", line)
+			tail.add(line)
 		}
 
 		if err := scanner.Err(); err != nil {
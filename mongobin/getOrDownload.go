@@ -3,6 +3,7 @@ package mongobin
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -26,35 +27,65 @@ func init() {
 	}
 }
 
+// The binaries we extract from MongoDB tarballs
+var extractedBinaries = []string{"mongod", "mongos"}
+
 // GetOrDownloadMongod returns the path to the mongod binary from the tarball
 // at the given URL. If the URL has not yet been downloaded, it's downloaded
 // and saved the the cache. If it has been downloaded, the existing mongod
 // path is returned.
 func GetOrDownloadMongod(urlStr string, cachePath string, logger *memongolog.Logger) (string, error) {
+	return GetOrDownloadMongodContext(context.Background(), urlStr, cachePath, logger)
+}
+
+// GetOrDownloadMongodContext is like GetOrDownloadMongod, but the download and
+// extraction are cancelled when ctx is done.
+func GetOrDownloadMongodContext(ctx context.Context, urlStr string, cachePath string, logger *memongolog.Logger) (string, error) {
+	return getOrDownload(ctx, urlStr, cachePath, "mongod", logger)
+}
+
+// GetOrDownloadMongos is like GetOrDownloadMongod, but returns the path to
+// the mongos binary from the tarball. If the tarball was downloaded by an
+// older version of memongo that only extracted mongod, it's downloaded again.
+func GetOrDownloadMongos(urlStr string, cachePath string, logger *memongolog.Logger) (string, error) {
+	return GetOrDownloadMongosContext(context.Background(), urlStr, cachePath, logger)
+}
+
+// GetOrDownloadMongosContext is like GetOrDownloadMongos, but the download and
+// extraction are cancelled when ctx is done.
+func GetOrDownloadMongosContext(ctx context.Context, urlStr string, cachePath string, logger *memongolog.Logger) (string, error) {
+	return getOrDownload(ctx, urlStr, cachePath, "mongos", logger)
+}
+
+func getOrDownload(ctx context.Context, urlStr string, cachePath string, binName string, logger *memongolog.Logger) (string, error) {
 	dirname, dirErr := directoryNameForURL(urlStr)
 	if dirErr != nil {
 		return "", dirErr
 	}
 
 	dirPath := path.Join(cachePath, dirname)
-	mongodPath := path.Join(dirPath, "mongod")
+	binPath := path.Join(dirPath, binName)
 
 	// Check the cache
-	existsInCache, existsErr := afs.Exists(mongodPath)
+	existsInCache, existsErr := afs.Exists(binPath)
 	if existsErr != nil {
-		return "", fmt.Errorf("error while checking for mongod in cache: %s", existsErr)
+		return "", fmt.Errorf("error while checking for %s in cache: %s", binName, existsErr)
 	}
 	if existsInCache {
-		logger.Debugf("mongod from %s exists in cache at %s", urlStr, mongodPath)
-		return mongodPath, nil
+		logger.Debugf("%s from %s exists in cache at %s", binName, urlStr, binPath)
+		return binPath, nil
 	}
 
-	logger.Infof("mongod from %s does not exist in cache, downloading to %s", urlStr, mongodPath)
+	logger.Infof("%s from %s does not exist in cache, downloading to %s", binName, urlStr, dirPath)
 	downloadStartTime := time.Now()
 
 	// Download the file
-	// nolint:gosec
-	resp, httpGetErr := http.Get(urlStr)
+	req, reqErr := http.NewRequest(http.MethodGet, urlStr, nil)
+	if reqErr != nil {
+		return "", fmt.Errorf("error creating request for %s: %s", urlStr, reqErr)
+	}
+
+	resp, httpGetErr := http.DefaultClient.Do(req.WithContext(ctx))
 	if httpGetErr != nil {
 		return "", fmt.Errorf("error getting tarball from %s: %s", urlStr, httpGetErr)
 	}
@@ -79,63 +110,99 @@ func GetOrDownloadMongod(urlStr string, cachePath string, logger *memongolog.Log
 		return "", fmt.Errorf("error seeking back to start of file: %s", seekErr)
 	}
 
-	// Extract mongod
-	gzReader, gzErr := gzip.NewReader(tgzTempFile)
+	mkdirErr := afs.MkdirAll(dirPath, 0755)
+	if mkdirErr != nil {
+		return "", fmt.Errorf("error creating directory %s: %s", dirPath, mkdirErr)
+	}
+
+	// Extract mongod and mongos
+	gzReader, gzErr := gzip.NewReader(&contextReader{ctx: ctx, r: tgzTempFile})
 	if gzErr != nil {
 		return "", fmt.Errorf("error intializing gzip reader from %s: %s", tgzTempFile.Name(), gzErr)
 	}
 
 	tarReader := tar.NewReader(gzReader)
 
+	foundBinary := false
 	for {
 		nextFile, tarErr := tarReader.Next()
 		if tarErr == io.EOF {
-			return "", fmt.Errorf("did not find a mongod binary in the tar from %s", urlStr)
+			break
 		}
 		if tarErr != nil {
 			return "", fmt.Errorf("error reading from tar: %s", tarErr)
 		}
 
-		if strings.HasSuffix(nextFile.Name, "bin/mongod") {
-			break
+		for _, name := range extractedBinaries {
+			if strings.HasSuffix(nextFile.Name, "bin/"+name) {
+				extractErr := extractBinary(tarReader, path.Join(dirPath, name))
+				if extractErr != nil {
+					return "", extractErr
+				}
+
+				if name == binName {
+					foundBinary = true
+				}
+			}
 		}
 	}
 
-	mkdirErr := afs.MkdirAll(path.Dir(mongodPath), 0755)
-	if mkdirErr != nil {
-		return "", fmt.Errorf("error creating directory %s: %s", path.Dir(mongodPath), mkdirErr)
+	if !foundBinary {
+		return "", fmt.Errorf("did not find a %s binary in the tar from %s", binName, urlStr)
 	}
 
+	logger.Infof("finished downloading %s to %s in %s", binName, binPath, time.Since(downloadStartTime).String())
+
+	return binPath, nil
+}
+
+// extractBinary writes the current file from the tar reader to the given path
+// and makes it executable.
+func extractBinary(tarReader io.Reader, binPath string) error {
 	// Extract to a temp file first, then copy to the destination, so we get
 	// atomic behavior if there's multiple parallel downloaders
-	mongodTmpFile, tmpFileErr := afs.TempFile("", "")
+	binTmpFile, tmpFileErr := afs.TempFile("", "")
 	if tmpFileErr != nil {
-		return "", fmt.Errorf("error creating temp file for mongod: %s", tmpFileErr)
+		return fmt.Errorf("error creating temp file for %s: %s", binPath, tmpFileErr)
 	}
-	defer func() {
-		_ = mongodTmpFile.Close()
-	}()
 
-	_, writeErr := io.Copy(mongodTmpFile, tarReader)
+	_, writeErr := io.Copy(binTmpFile, tarReader)
 	if writeErr != nil {
-		return "", fmt.Errorf("error writing mongod binary at %s: %s", mongodTmpFile.Name(), writeErr)
+		_ = binTmpFile.Close()
+		_ = afs.Remove(binTmpFile.Name())
+		return fmt.Errorf("error writing binary at %s: %s", binTmpFile.Name(), writeErr)
 	}
 
-	_ = mongodTmpFile.Close()
+	_ = binTmpFile.Close()
 
-	chmodErr := afs.Chmod(mongodTmpFile.Name(), 0755)
+	chmodErr := afs.Chmod(binTmpFile.Name(), 0755)
 	if chmodErr != nil {
-		return "", fmt.Errorf("error chmod-ing mongodb binary at %s: %s", mongodTmpFile, chmodErr)
+		_ = afs.Remove(binTmpFile.Name())
+		return fmt.Errorf("error chmod-ing binary at %s: %s", binTmpFile.Name(), chmodErr)
 	}
 
-	renameErr := afs.Rename(mongodTmpFile.Name(), mongodPath)
+	renameErr := afs.Rename(binTmpFile.Name(), binPath)
 	if renameErr != nil {
-		return "", fmt.Errorf("error writing mongod binary from %s to %s: %s", mongodTmpFile.Name(), mongodPath, renameErr)
+		_ = afs.Remove(binTmpFile.Name())
+		return fmt.Errorf("error writing binary from %s to %s: %s", binTmpFile.Name(), binPath, renameErr)
 	}
 
-	logger.Infof("finished downloading mongod to %s in %s", mongodPath, time.Since(downloadStartTime).String())
+	return nil
+}
+
+// contextReader is an io.Reader that fails once its context is done, so we
+// can cancel long-running copies.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
 
-	return mongodPath, nil
+	return cr.r.Read(p)
 }
 
 // After the download a tarball, we extract it to a directory in the cache.
@@ -1,6 +1,9 @@
 package mongobin
 
 import (
+	"context"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/benweissmann/memongo/memongolog"
@@ -45,3 +48,87 @@ func TestGetOrDownload(t *testing.T) {
 
 	assert.Equal(t, stat.ModTime(), stat2.ModTime())
 }
+
+func TestGetOrDownloadMongos(t *testing.T) {
+	afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	spec := DownloadSpec{
+		Version:        "4.0.5",
+		Platform:       "osx",
+		SSLBuildNeeded: true,
+		Arch:           "x86_64",
+	}
+
+	cacheDir, err := afs.TempDir("", "")
+	require.NoError(t, err)
+
+	// Downloading mongod should also extract mongos
+	mongodPath, err := GetOrDownloadMongod(spec.GetDownloadURL(), cacheDir, memongolog.New(nil, memongolog.LogLevelDebug))
+	require.NoError(t, err)
+
+	mongodStat, err := afs.Stat(mongodPath)
+	require.NoError(t, err)
+
+	mongosPath, err := GetOrDownloadMongos(spec.GetDownloadURL(), cacheDir, memongolog.New(nil, memongolog.LogLevelDebug))
+	require.NoError(t, err)
+
+	assert.Equal(t, cacheDir+"/mongodb-osx-ssl-x86_64-4_0_5_tgz_d50ef2155b/mongos", mongosPath)
+
+	stat, err := afs.Stat(mongosPath)
+	require.NoError(t, err)
+	assert.True(t, stat.Mode()&0100 != 0)
+
+	// mongod should not have been downloaded again
+	mongodStat2, err := afs.Stat(mongodPath)
+	require.NoError(t, err)
+	assert.Equal(t, mongodStat.ModTime(), mongodStat2.ModTime())
+}
+
+func TestGetOrDownloadCancelled(t *testing.T) {
+	afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	cacheDir, err := afs.TempDir("", "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = GetOrDownloadMongodContext(ctx, "https://fastdl.mongodb.org/osx/mongodb-osx-ssl-x86_64-4.0.5.tgz", cacheDir, memongolog.New(nil, memongolog.LogLevelDebug))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "context canceled")
+}
+
+func TestExtractBinaryCancelled(t *testing.T) {
+	afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := extractBinary(&contextReader{ctx: ctx, r: strings.NewReader("mongod")}, "/cache/mongod")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "context canceled")
+
+	// Neither the binary nor a partial temp file is left behind
+	exists, err := afs.Exists("/cache/mongod")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	tmpFiles, err := afs.ReadDir(os.TempDir())
+	require.NoError(t, err)
+	assert.Empty(t, tmpFiles)
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &contextReader{ctx: ctx, r: strings.NewReader("hello")}
+
+	buf := make([]byte, 2)
+	n, err := reader.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	cancel()
+
+	_, err = reader.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ProcessIdentity returns a string that identifies the process with the
+// given pid, and won't match a later process that reuses the pid: its start
+// time, in clock ticks since boot. Zombies have no identity, because they
+// have already exited.
+func ProcessIdentity(pid int) (string, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", err
+	}
+
+	// The command name (in parentheses) can contain spaces, so we split
+	// the fields after it. They start with the state (field 3), and the start
+	// time is field 22.
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return "", fmt.Errorf("could not parse /proc/%d/stat", pid)
+	}
+
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return "", fmt.Errorf("could not parse /proc/%d/stat", pid)
+	}
+	if fields[0] == "Z" {
+		return "", errors.New("process has exited")
+	}
+
+	return fields[19], nil
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package monitor
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ProcessIdentity returns a string that identifies the process with the
+// given pid, and won't match a later process that reuses the pid: its start
+// time, as reported by ps. Zombies have no identity, because they have
+// already exited.
+func ProcessIdentity(pid int) (string, error) {
+	// pid is an integer
+	//nolint:gosec
+	out, err := exec.Command("ps", "-o", "state=,lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", errors.New("process not found")
+	}
+	if strings.HasPrefix(fields[0], "Z") {
+		return "", errors.New("process has exited")
+	}
+
+	return strings.Join(fields[1:], " "), nil
+}
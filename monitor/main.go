@@ -2,19 +2,120 @@ package monitor
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
+	"strconv"
+	"syscall"
 )
 
+// Environment variables that tell a re-executed copy of the current binary to
+// run as a watcher, and what to watch
+const (
+	watcherEnv    = "MEMONGO_WATCHER"
+	watcherPIDEnv = "MEMONGO_WATCHER_PID"
+	watcherDirEnv = "MEMONGO_WATCHER_DIR"
+
+	// Set by RunMonitor, to watch a given parent pid rather than the pipe
+	watcherParentEnv = "MEMONGO_WATCHER_PARENT"
+)
+
+// Watcher is a subprocess that kills a child process, and removes its data
+// directory, when the current process exits.
+//
+// The watcher is a copy of the current binary, re-executed to run the
+// watcher instead of main (see init). It inherits the read end of a pipe
+// whose write end only this process holds, so it sees EOF the moment this
+// process exits, however it exits.
+type Watcher struct {
+	cmd *exec.Cmd
+
+	// The write end of the pipe. It's never written to; it just needs to stay
+	// open (and referenced, so it isn't closed by a finalizer) for as long as
+	// the watcher should keep waiting.
+	pipe *os.File
+}
+
+// Start runs a watcher that kills the given child pid (after checking it's
+// still the same process) and removes dir (if it's not "") when the current
+// process exits.
+func Start(child int, dir string) (*Watcher, error) {
+	pipeReader, pipeWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating watcher pipe: %s", err)
+	}
+
+	cmd, err := watcherCommand(child, watcherDirEnv+"="+dir)
+	if err != nil {
+		_ = pipeReader.Close()
+		_ = pipeWriter.Close()
+		return nil, err
+	}
+	cmd.ExtraFiles = []*os.File{pipeReader}
+
+	err = cmd.Start()
+	_ = pipeReader.Close()
+	if err != nil {
+		_ = pipeWriter.Close()
+		return nil, fmt.Errorf("error starting watcher process: %s", err)
+	}
+
+	return &Watcher{cmd: cmd, pipe: pipeWriter}, nil
+}
+
+// watcherCommand returns the command to run a watcher for child, with the
+// given extra environment variables
+func watcherCommand(child int, env ...string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("error finding the current executable to run the watcher: %s", err)
+	}
+
+	// exe is the current binary
+	//nolint:gosec
+	cmd := exec.Command(exe)
+	cmd.Args = []string{"memongo-watcher"}
+	cmd.Env = append(os.Environ(), watcherEnv+"=1", watcherPIDEnv+"="+strconv.Itoa(child))
+	cmd.Env = append(cmd.Env, env...)
+
+	// Put the watcher in its own process group, so a Ctrl-C in the terminal
+	// doesn't kill it along with this process
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	return cmd, nil
+}
+
+// Stop kills and reaps the watcher, without touching the child process or
+// its data directory
+func (w *Watcher) Stop() error {
+	// Kill the watcher before closing the pipe, which it would take to mean
+	// that this process exited
+	err := w.cmd.Process.Kill()
+	if err != nil {
+		return fmt.Errorf("error stopping watcher process: %s", err)
+	}
+
+	// The watcher exits with an error because we killed it
+	_ = w.cmd.Wait()
+	_ = w.pipe.Close()
+
+	return nil
+}
+
 // RunMonitor runs a subprocess that kills the given child pid when the
-// parent pid exits.
+// parent pid exits. Unlike Start, it polls for the parent to exit (once a
+// second), rather than noticing immediately, and it doesn't remove any
+// directory.
+//
+// Deprecated: Use Start, which watches the current process.
 func RunMonitor(parent int, child int) (*exec.Cmd, error) {
-	// monitorScript returns a safe script; it's parameterized only by integers
-	//nolint:gosec
-	cmd := exec.Command("/bin/sh", "-c", monitorScript(parent, child))
+	cmd, err := watcherCommand(child, watcherParentEnv+"="+strconv.Itoa(parent))
+	if err != nil {
+		return nil, err
+	}
 
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil {
-		return nil, fmt.Errorf("Error starting watcher process: %s", err)
+		return nil, fmt.Errorf("error starting watcher process: %s", err)
 	}
 
 	return cmd, nil
@@ -1,8 +1,10 @@
 package monitor
 
 import (
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"syscall"
 	"testing"
 	"time"
 
@@ -10,32 +12,120 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func runSleep() *os.Process {
-	cmd := exec.Command("/bin/sh", "sleep", "10")
+func runSleep(t *testing.T) *exec.Cmd {
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
 
-	err := cmd.Start()
-	if err != nil {
-		panic(err)
+	return cmd
+}
+
+// simulateParentExit closes the watcher's pipe, which is what happens when
+// the process that started it exits
+func simulateParentExit(t *testing.T, w *Watcher) {
+	require.NoError(t, w.pipe.Close())
+
+	// The watcher exits on its own once it's cleaned up
+	require.NoError(t, w.cmd.Wait())
+}
+
+// assertKilled checks that cmd exits with SIGKILL within 3 seconds
+func assertKilled(t *testing.T, cmd *exec.Cmd) {
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+	case <-time.After(3 * time.Second):
+		t.Fatal("child was not killed")
 	}
 
-	return cmd.Process
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	assert.Equal(t, syscall.SIGKILL, status.Signal())
+}
+
+func TestWatcher(t *testing.T) {
+	child := runSleep(t)
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := Start(child.Process.Pid, dir)
+	require.NoError(t, err)
+
+	simulateParentExit(t, w)
+	assertKilled(t, child)
+
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWatcherStoppedChild(t *testing.T) {
+	child := runSleep(t)
+
+	// Stop the child, like Server.Pause does
+	require.NoError(t, child.Process.Signal(syscall.SIGSTOP))
+
+	w, err := Start(child.Process.Pid, "")
+	require.NoError(t, err)
+
+	simulateParentExit(t, w)
+	assertKilled(t, child)
 }
 
-func TestMonitor(t *testing.T) {
-	parent := runSleep()
-	child := runSleep()
+func TestWatcherStop(t *testing.T) {
+	child := runSleep(t)
+	defer func() {
+		_ = child.Process.Kill()
+		_ = child.Wait()
+	}()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
 
-	// Start the monitor
-	_, err := RunMonitor(parent.Pid, child.Pid)
+	w, err := Start(child.Process.Pid, dir)
 	require.NoError(t, err)
+	require.NoError(t, w.Stop())
+
+	// Neither the child nor its directory are touched
+	require.NoError(t, child.Process.Signal(syscall.Signal(0)))
+
+	_, err = os.Stat(dir)
+	require.NoError(t, err)
+}
 
-	// Kill the parent
-	require.NoError(t, parent.Kill())
+func TestKillChildChecksIdentity(t *testing.T) {
+	child := runSleep(t)
 
-	// Child should die within 3 seconds
-	startWait := time.Now()
-	_, err = child.Wait()
+	identity, err := ProcessIdentity(child.Process.Pid)
 	require.NoError(t, err)
 
-	assert.True(t, time.Since(startWait).Seconds() < 3)
+	// A different process with the same pid is left alone
+	require.False(t, killChild(child.Process.Pid, identity+"0"))
+	require.NoError(t, child.Process.Signal(syscall.Signal(0)))
+
+	require.True(t, killChild(child.Process.Pid, identity))
+	assertKilled(t, child)
+
+	// Once it's been reaped, it has no identity
+	_, err = ProcessIdentity(child.Process.Pid)
+	require.Error(t, err)
+}
+
+func TestRunMonitor(t *testing.T) {
+	parent := runSleep(t)
+	child := runSleep(t)
+
+	cmd, err := RunMonitor(parent.Process.Pid, child.Process.Pid)
+	require.NoError(t, err)
+
+	require.NoError(t, parent.Process.Kill())
+	_ = parent.Wait()
+
+	assertKilled(t, child)
+	require.NoError(t, cmd.Wait())
 }
@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The file descriptor of the pipe from the parent process, which is the
+// first of exec.Cmd.ExtraFiles
+const watcherPipeFD = 3
+
+// How long to wait for the child to exit after killing it, before removing
+// its data directory anyway
+const childExitTimeout = 10 * time.Second
+
+// How often a watcher started by RunMonitor checks whether its parent exited
+const parentPollInterval = time.Second
+
+// If this process was started by Start, run the watcher instead of main
+func init() {
+	if os.Getenv(watcherEnv) == "" {
+		return
+	}
+
+	runWatcher()
+	os.Exit(0)
+}
+
+func runWatcher() {
+	// The parent handles signals to its process group; we wait for it to exit
+	signal.Ignore(syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
+
+	child, err := strconv.Atoi(os.Getenv(watcherPIDEnv))
+	if err != nil {
+		return
+	}
+	dir := os.Getenv(watcherDirEnv)
+
+	// Remember which process the child is, so we don't kill an unrelated
+	// process if the child exits and its pid is reused. If it's already gone,
+	// there's nothing to kill, but we still clean up after it.
+	identity, identityErr := ProcessIdentity(child)
+
+	waitForParent()
+
+	if identityErr == nil {
+		killChild(child, identity)
+	}
+
+	if dir != "" {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// waitForParent blocks until the parent exits. Normally, that's when the
+// write end of the pipe is closed; watchers started by RunMonitor poll the
+// parent's pid instead.
+func waitForParent() {
+	parent, err := strconv.Atoi(os.Getenv(watcherParentEnv))
+	if err != nil {
+		pipe := os.NewFile(watcherPipeFD, "memongo-watcher-pipe")
+		_, _ = io.Copy(ioutil.Discard, pipe)
+		return
+	}
+
+	identity, err := ProcessIdentity(parent)
+	if err != nil {
+		return
+	}
+
+	for isProcess(parent, identity) {
+		time.Sleep(parentPollInterval)
+	}
+}
+
+// killChild kills pid with SIGKILL if it's still the process with the given
+// identity, and waits (up to childExitTimeout) for it to exit. It returns
+// false if pid is no longer that process.
+func killChild(pid int, identity string) bool {
+	if !isProcess(pid, identity) {
+		return false
+	}
+
+	_ = syscall.Kill(pid, syscall.SIGKILL)
+
+	// Once our parent has exited, the child is reparented to init, which
+	// reaps it
+	deadline := time.Now().Add(childExitTimeout)
+	for isProcess(pid, identity) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// isProcess returns true if pid is a running process with the given identity
+func isProcess(pid int, identity string) bool {
+	current, err := ProcessIdentity(pid)
+	return err == nil && current == identity
+}
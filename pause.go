@@ -0,0 +1,75 @@
+package memongo
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Pause freezes the mongod process with SIGSTOP. The kernel still accepts
+// TCP connections on its port, but mongod never answers them, which is how a
+// hung server looks to clients. Use it to test socket timeouts and heartbeat
+// handling. Call Resume to unfreeze it.
+//
+// A paused server is still cleaned up properly: Stop resumes it so it can
+// shut down cleanly, and the watcher kills it with SIGKILL (which works on
+// stopped processes) if this process dies.
+func (s *Server) Pause() error {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	if s.cmd == nil || s.hasExited() {
+		return ErrNotRunning
+	}
+
+	err := s.cmd.Process.Signal(syscall.SIGSTOP)
+	if err != nil {
+		return fmt.Errorf("error pausing mongod: %s", err)
+	}
+
+	s.setPaused(true)
+	return nil
+}
+
+// Resume unfreezes a mongod process paused with Pause, using SIGCONT. It
+// does nothing if the server isn't paused.
+func (s *Server) Resume() error {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	return s.resume()
+}
+
+func (s *Server) resume() error {
+	if !s.paused {
+		return nil
+	}
+
+	if s.cmd == nil || s.hasExited() {
+		s.setPaused(false)
+		return ErrNotRunning
+	}
+
+	err := s.cmd.Process.Signal(syscall.SIGCONT)
+	if err != nil {
+		return fmt.Errorf("error resuming mongod: %s", err)
+	}
+
+	s.setPaused(false)
+	return nil
+}
+
+// Paused returns true if the server has been paused with Pause and not yet
+// resumed
+func (s *Server) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.paused
+}
+
+func (s *Server) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = paused
+}
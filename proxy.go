@@ -0,0 +1,75 @@
+package memongo
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/benweissmann/memongo/proxy"
+)
+
+// startProxy starts a fault-injecting proxy in front of the server
+func (s *Server) startProxy() error {
+	_, port := s.address()
+	network, address := "tcp", net.JoinHostPort(s.tcpHost(), strconv.Itoa(port))
+	if s.opts.DisableTCP {
+		network, address = "unix", s.socketPath()
+	}
+
+	p, err := proxy.New(network, address)
+	if err != nil {
+		return err
+	}
+
+	s.proxy = p
+	return nil
+}
+
+// stopProxy closes the proxy, if there is one
+func (s *Server) stopProxy() error {
+	if s.proxy == nil {
+		return nil
+	}
+
+	p := s.proxy
+	s.proxy = nil
+
+	return p.Close()
+}
+
+// Proxy returns the fault-injecting proxy in front of the server if it was
+// started with Options.Proxy, or nil otherwise. Use it to add latency,
+// throttle bandwidth, drop or refuse connections, or black-hole traffic for
+// clients connected with ProxyURI().
+func (s *Server) Proxy() *proxy.Proxy {
+	return s.proxy
+}
+
+// ProxyURI returns a mongodb:// URI that connects through the proxy if the
+// server was started with Options.Proxy, or "" otherwise. Like URI(), it
+// includes any credentials and options needed to connect.
+//
+// For replica set members, the URI connects directly to the member rather
+// than including the replicaSet option, since the driver would otherwise
+// discover the member's real address and bypass the proxy.
+func (s *Server) ProxyURI() string {
+	if s.proxy == nil {
+		return ""
+	}
+
+	username, password := s.credentials()
+	uri, err := url.Parse(s.buildUserURI(s.proxy.Addr(), "", username, password, s.authSource()))
+	if err != nil {
+		// We built the URI ourselves, so this can't happen
+		panic(err)
+	}
+
+	if s.replicaSetName != "" {
+		query := uri.Query()
+		query.Del("replicaSet")
+		query.Set("connect", "direct")
+		uri.RawQuery = query.Encode()
+	}
+
+	return uri.String()
+}
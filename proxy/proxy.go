@@ -0,0 +1,414 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The most we read from one side of a connection before forwarding it
+const bufferSize = 32 * 1024
+
+// How many chunks per second we split writes into when throttling
+// bandwidth, so throttled traffic trickles rather than arriving in bursts
+const throttleChunksPerSecond = 20
+
+// How many chunks each direction of a connection may have read but not yet
+// forwarded. Once it's full, the proxy stops reading until it catches up.
+const pipeQueueLength = 16
+
+// How long to wait before accepting again after an error
+const acceptRetryInterval = 10 * time.Millisecond
+
+// Proxy is a TCP proxy that forwards connections to a target address, with
+// controls for simulating slow or broken networks. It's safe to change the
+// controls while connections are open.
+type Proxy struct {
+	listener net.Listener
+
+	// The network ("tcp" or "unix") and address to forward connections to
+	targetNetwork string
+	targetAddress string
+
+	mu        sync.Mutex
+	conns     map[*conn]struct{}
+	latency   time.Duration
+	bandwidth int
+	refusing  bool
+	blackhole bool
+	closed    bool
+
+	// Closed when the blackhole is lifted, to wake up connections that are
+	// holding data
+	unblackholed chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// conn is a client connection and the connection we opened to the target
+// for it
+type conn struct {
+	client   net.Conn
+	upstream net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// chunk is data read from one side of a connection, waiting to be forwarded
+// to the other
+type chunk struct {
+	data   []byte
+	readAt time.Time
+}
+
+// close closes both sides of the connection
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.client.Close()
+		_ = c.upstream.Close()
+	})
+}
+
+// sleep waits for d, or until the connection is closed. It returns false if
+// the connection was closed.
+func (c *conn) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// New starts a proxy listening on a random port on 127.0.0.1, which forwards
+// connections to the given address on the given network ("tcp" or "unix").
+func New(targetNetwork string, targetAddress string) (*Proxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error starting proxy listener: %s", err)
+	}
+
+	p := &Proxy{
+		listener:      listener,
+		targetNetwork: targetNetwork,
+		targetAddress: targetAddress,
+		conns:         map[*conn]struct{}{},
+	}
+
+	p.wg.Add(1)
+	go p.acceptLoop()
+
+	return p, nil
+}
+
+// Addr returns the host:port the proxy is listening on
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// SetLatency delays all traffic through the proxy, in each direction, by d.
+// Each chunk of data is forwarded d after the proxy read it, so a steady
+// stream of data is delayed by d as a whole, rather than by d for every
+// read. Pass 0 to remove the delay.
+func (p *Proxy) SetLatency(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.latency = d
+}
+
+// SetBandwidth throttles each direction of each connection to the given
+// number of bytes per second. Pass 0 to remove the limit.
+func (p *Proxy) SetBandwidth(bytesPerSecond int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bandwidth = bytesPerSecond
+}
+
+// SetRefuseConnections makes the proxy reset new connections as soon as
+// they're accepted (if refuse is true), or accept them again (if it's
+// false). Connections that are already open aren't affected.
+func (p *Proxy) SetRefuseConnections(refuse bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refusing = refuse
+}
+
+// SetBlackhole makes the proxy stop forwarding traffic, in both
+// directions, on new and existing connections (if blackhole is true), or
+// forward it again (if it's false). Connections stay open, so clients only
+// notice when they time out, like during a network partition.
+//
+// Nothing is dropped: the proxy holds on to data it has already read, and
+// stops reading once its queue is full, leaving the rest to back up in the
+// kernel. When the blackhole is lifted, the held data is delivered in order,
+// just as TCP retransmits it once a partition heals. So messages are never
+// cut off partway through.
+func (p *Proxy) SetBlackhole(blackhole bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.setBlackhole(blackhole)
+}
+
+// setBlackhole turns the blackhole on or off. p.mu must be held.
+func (p *Proxy) setBlackhole(blackhole bool) {
+	if blackhole == p.blackhole {
+		return
+	}
+
+	p.blackhole = blackhole
+	if blackhole {
+		p.unblackholed = make(chan struct{})
+	} else {
+		close(p.unblackholed)
+	}
+}
+
+// DropConnections closes all open connections through the proxy. New
+// connections are still accepted.
+func (p *Proxy) DropConnections() {
+	p.mu.Lock()
+	conns := make([]*conn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// Reset removes all the simulated faults: latency, bandwidth limits,
+// refusing connections, and black-holing traffic. Connections that were
+// dropped stay dropped.
+func (p *Proxy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.latency = 0
+	p.bandwidth = 0
+	p.refusing = false
+	p.setBlackhole(false)
+}
+
+// Close stops the proxy and closes all connections through it
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	err := p.listener.Close()
+	p.DropConnections()
+	p.wg.Wait()
+
+	if err != nil {
+		return fmt.Errorf("error closing proxy listener: %s", err)
+	}
+
+	return nil
+}
+
+// settings returns the current fault settings. If the proxy is
+// black-holing traffic, unblackholed is closed when it stops.
+func (p *Proxy) settings() (latency time.Duration, bandwidth int, unblackholed <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.blackhole {
+		unblackholed = p.unblackholed
+	}
+
+	return p.latency, p.bandwidth, unblackholed
+}
+
+func (p *Proxy) acceptLoop() {
+	defer p.wg.Done()
+
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+
+			if closed {
+				return
+			}
+
+			// Probably a temporary error, like running out of file
+			// descriptors
+			time.Sleep(acceptRetryInterval)
+			continue
+		}
+
+		p.mu.Lock()
+		refusing := p.refusing
+		p.mu.Unlock()
+
+		if refusing {
+			// Closing with no linger sends a reset, so the client sees the
+			// connection fail rather than a clean EOF
+			if tcpConn, ok := client.(*net.TCPConn); ok {
+				_ = tcpConn.SetLinger(0)
+			}
+			_ = client.Close()
+			continue
+		}
+
+		p.wg.Add(1)
+		go p.handle(client)
+	}
+}
+
+// handle connects a client to the target and forwards traffic between them
+// until either side closes its connection
+func (p *Proxy) handle(client net.Conn) {
+	defer p.wg.Done()
+
+	upstream, err := net.Dial(p.targetNetwork, p.targetAddress)
+	if err != nil {
+		_ = client.Close()
+		return
+	}
+
+	c := &conn{client: client, upstream: upstream, done: make(chan struct{})}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		c.close()
+		return
+	}
+	p.conns[c] = struct{}{}
+	p.mu.Unlock()
+
+	var pipes sync.WaitGroup
+	pipes.Add(2)
+	go func() {
+		defer pipes.Done()
+		p.pipe(c, upstream, client)
+	}()
+	go func() {
+		defer pipes.Done()
+		p.pipe(c, client, upstream)
+	}()
+	pipes.Wait()
+
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+}
+
+// pipe copies from src to dst, applying the proxy's faults, until either
+// side fails. It then closes the whole connection.
+//
+// Reading and forwarding happen in separate goroutines, so the proxy keeps
+// reading (and timestamping what it reads) while earlier data waits out the
+// latency.
+func (p *Proxy) pipe(c *conn, dst net.Conn, src net.Conn) {
+	chunks := make(chan chunk, pipeQueueLength)
+	go c.read(src, chunks)
+
+	for ch := range chunks {
+		if !p.forward(c, dst, ch) {
+			break
+		}
+	}
+
+	// Closing the connection stops the reader; wait for it to finish
+	c.close()
+	for range chunks {
+	}
+}
+
+// read reads from src into chunks until src fails or the connection is
+// closed, then closes chunks
+func (c *conn) read(src net.Conn, chunks chan<- chunk) {
+	defer close(chunks)
+
+	buf := make([]byte, bufferSize)
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			select {
+			case chunks <- chunk{data: data, readAt: time.Now()}:
+			case <-c.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forward writes a chunk to dst, once the configured latency has passed
+// since it was read, and at the configured bandwidth. If the proxy is
+// black-holing traffic, it waits until it stops. It returns false if the
+// connection has failed.
+func (p *Proxy) forward(c *conn, dst net.Conn, ch chunk) bool {
+	latency, bandwidth, unblackholed := p.settings()
+	for unblackholed != nil {
+		select {
+		case <-unblackholed:
+		case <-c.done:
+			return false
+		}
+
+		latency, bandwidth, unblackholed = p.settings()
+	}
+
+	if !c.sleep(time.Until(ch.readAt.Add(latency))) {
+		return false
+	}
+
+	data := ch.data
+	for len(data) > 0 {
+		part := data
+		if bandwidth > 0 {
+			partSize := bandwidth / throttleChunksPerSecond
+			if partSize < 1 {
+				partSize = 1
+			}
+			if len(part) > partSize {
+				part = part[:partSize]
+			}
+		}
+
+		// Wait for the part's share of the bandwidth before sending it, so
+		// nothing arrives sooner than it would over a slow link
+		if bandwidth > 0 && !c.sleep(time.Duration(len(part))*time.Second/time.Duration(bandwidth)) {
+			return false
+		}
+
+		_, err := dst.Write(part)
+		if err != nil {
+			return false
+		}
+		data = data[len(part):]
+	}
+
+	return true
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoServer starts a TCP server that echoes back everything it reads
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l
+}
+
+// startProxy starts an echo server and a proxy in front of it
+func startProxy(t *testing.T) (*Proxy, func()) {
+	echo := startEchoServer(t)
+
+	p, err := New("tcp", echo.Addr().String())
+	require.NoError(t, err)
+
+	return p, func() {
+		require.NoError(t, p.Close())
+		echo.Close()
+	}
+}
+
+// roundTrip sends msg through conn and reads the echo, failing if it takes
+// longer than timeout
+func roundTrip(conn net.Conn, msg string, timeout time.Duration) (string, error) {
+	err := conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = conn.Write([]byte(msg))
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	return string(buf), err
+}
+
+func TestProxyForwards(t *testing.T) {
+	p, cleanup := startProxy(t)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	reply, err := roundTrip(conn, "hello", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", reply)
+}
+
+func TestProxyLatency(t *testing.T) {
+	p, cleanup := startProxy(t)
+	defer cleanup()
+
+	p.SetLatency(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The latency applies in each direction
+	start := time.Now()
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "round trip took %s", time.Since(start))
+
+	p.SetLatency(0)
+
+	start = time.Now()
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "round trip took %s", time.Since(start))
+}
+
+func TestProxyLatencyLargeMessage(t *testing.T) {
+	p, cleanup := startProxy(t)
+	defer cleanup()
+
+	p.SetLatency(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The message takes many reads to get through the proxy, but it's only
+	// delayed once in each direction, not once per read
+	msg := string(make([]byte, 8*bufferSize))
+
+	start := time.Now()
+	reply, err := roundTrip(conn, msg, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, msg, reply)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "round trip took %s", time.Since(start))
+	assert.True(t, time.Since(start) < time.Second, "round trip took %s", time.Since(start))
+}
+
+func TestProxyBandwidth(t *testing.T) {
+	p, cleanup := startProxy(t)
+	defer cleanup()
+
+	// 1000 bytes at 5000 bytes/second takes at least 0.2 seconds to get to
+	// the server, and the echo trickles back behind it
+	p.SetBandwidth(5000)
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := string(make([]byte, 1000))
+
+	start := time.Now()
+	reply, err := roundTrip(conn, msg, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, msg, reply)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "round trip took %s", time.Since(start))
+}
+
+func TestProxyDropConnections(t *testing.T) {
+	p, cleanup := startProxy(t)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.NoError(t, err)
+
+	p.DropConnections()
+
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.Error(t, err)
+
+	// New connections still work
+	conn, err = net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.NoError(t, err)
+}
+
+func TestProxyRefuseConnections(t *testing.T) {
+	p, cleanup := startProxy(t)
+	defer cleanup()
+
+	existing, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer existing.Close()
+
+	_, err = roundTrip(existing, "hello", time.Second)
+	require.NoError(t, err)
+
+	p.SetRefuseConnections(true)
+
+	conn, err := net.Dial("tcp", p.Addr())
+	if err == nil {
+		defer conn.Close()
+		_, err = roundTrip(conn, "hello", time.Second)
+	}
+	require.Error(t, err)
+
+	// Existing connections aren't affected
+	_, err = roundTrip(existing, "hello", time.Second)
+	require.NoError(t, err)
+
+	p.SetRefuseConnections(false)
+
+	conn, err = net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.NoError(t, err)
+}
+
+func TestProxyBlackhole(t *testing.T) {
+	p, cleanup := startProxy(t)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	p.SetBlackhole(true)
+
+	// The traffic disappears, so we time out rather than getting an error
+	_, err = roundTrip(conn, "hello", 200*time.Millisecond)
+	require.Error(t, err)
+
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout(), "unexpected error: %s", err)
+
+	// Once the partition heals, the held message is delivered, and the
+	// connection works again
+	p.Reset()
+
+	buf := make([]byte, len("hello"))
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	reply, err := roundTrip(conn, "world", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "world", reply)
+}
+
+func TestProxyClose(t *testing.T) {
+	p, cleanup := startProxy(t)
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.NoError(t, err)
+
+	cleanup()
+
+	_, err = roundTrip(conn, "hello", time.Second)
+	require.Error(t, err)
+
+	_, err = net.Dial("tcp", p.Addr())
+	require.Error(t, err)
+
+	// Closing twice is fine
+	require.NoError(t, p.Close())
+}
@@ -0,0 +1,31 @@
+package memongo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyURI(t *testing.T) {
+	server := &Server{opts: &Options{}, port: 27100}
+	assert.Equal(t, "", server.ProxyURI())
+
+	require.NoError(t, server.startProxy())
+	defer server.stopProxy()
+
+	assert.Equal(t, "mongodb://"+server.Proxy().Addr(), server.ProxyURI())
+
+	// Replica set members are connected to directly, so the driver doesn't
+	// bypass the proxy
+	server.replicaSetName = "rs0"
+	server.username = "memongo"
+	server.password = "pw"
+	server.opts.AuthMechanism = AuthMechanismSCRAMSHA256
+
+	assert.Equal(t, "mongodb://memongo:pw@"+server.Proxy().Addr()+"/?authMechanism=SCRAM-SHA-256&authSource=admin&connect=direct", server.ProxyURI())
+
+	require.NoError(t, server.stopProxy())
+	assert.Nil(t, server.Proxy())
+	assert.Equal(t, "", server.ProxyURI())
+}
@@ -0,0 +1,416 @@
+package memongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benweissmann/memongo/memongolog"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const defaultReplicaSetName = "rs0"
+
+// How often to poll a replica set member while waiting for an election
+const replicaSetPollInterval = 100 * time.Millisecond
+
+// How long to wait for an election after a failover. Elections after a
+// primary is killed take at least electionTimeoutMillis (10 seconds by
+// default), so this is longer than the startup timeout.
+const electionWaitTimeout = 30 * time.Second
+
+// ReplicaSet represents a running replica set made up of several MongoDB
+// servers
+type ReplicaSet struct {
+	name    string
+	members []*Server
+	logger  *memongolog.Logger
+
+	// mu is held while members are killed, restarted, or stopped, and
+	// while checking which of them are running, so those can be done
+	// from different goroutines
+	mu sync.Mutex
+}
+
+// StartReplicaSet starts the given number of mongod processes, each with its
+// own port and data directory, initiates them into a replica set, and waits
+// for the set to elect a primary.
+//
+// If opts.Port is given, the members listen on consecutive ports starting at
+// opts.Port. opts.ReplicaSet is ignored; every member is always started as a
+// replica set member. opts.Auth, opts.TLS, and opts.Restart are not
+// supported.
+func StartReplicaSet(opts *Options, members int) (*ReplicaSet, error) {
+	if members < 1 {
+		return nil, errors.New("a replica set needs at least one member")
+	}
+	if opts.Auth {
+		// Members would need a shared keyfile to authenticate to each other
+		return nil, errors.New("memongo does not support Auth for multi-member replica sets; use Options.ReplicaSet for a single-node replica set with auth")
+	}
+	if opts.TLS {
+		// Members would need certificates from a shared CA
+		return nil, errors.New("memongo does not support TLS for multi-member replica sets; use Options.ReplicaSet for a single-node replica set with TLS")
+	}
+
+	if opts.Restart.Mode == RestartOnFailure {
+		return nil, errors.New("memongo does not support Restart for multi-member replica sets")
+	}
+
+	opts.ReplicaSet = true
+
+	err := opts.fillDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := opts.getLogger()
+	sweepOnStart(opts, logger)
+
+	logger.Infof("Starting MongoDB replica set with %d members and options %#v", members, opts)
+
+	ctx := context.Background()
+
+	binPath, err := opts.getOrDownloadBinPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("Using binary %s", binPath)
+
+	err = opts.fillVersionDefaults(ctx, binPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return startReplicaSet(ctx, opts, binPath, members, opts.Port, nil)
+}
+
+// startReplicaSet starts and initiates a replica set, with members listening
+// on consecutive ports from basePort (or on random ports if basePort is 0).
+// opts must already have had its defaults filled. roleArgs are passed to
+// every member.
+func startReplicaSet(ctx context.Context, opts *Options, binPath string, members int, basePort int, roleArgs []string) (*ReplicaSet, error) {
+	logger := opts.getLogger()
+
+	rs := &ReplicaSet{
+		name:   opts.ReplicaSetName,
+		logger: logger,
+	}
+
+	for i := 0; i < members; i++ {
+		port := 0
+		if basePort != 0 {
+			port = basePort + i
+		}
+
+		member, err := newServer(opts, binPath, port)
+		if err != nil {
+			rs.Stop()
+			return nil, err
+		}
+		member.roleArgs = roleArgs
+
+		err = member.launch(ctx)
+		if err != nil {
+			_ = member.removeDBDir()
+			rs.Stop()
+			return nil, err
+		}
+
+		rs.members = append(rs.members, member)
+	}
+
+	logger.Debugf("Initiating replica set %s", rs.name)
+
+	initCtx, cancel := context.WithTimeout(ctx, electionWaitTimeout)
+	defer cancel()
+
+	err := initiateReplicaSet(initCtx, rs.name, rs.members)
+	if err != nil {
+		rs.Stop()
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// Name returns the name of the replica set
+func (rs *ReplicaSet) Name() string {
+	return rs.name
+}
+
+// Members returns all the servers in the replica set, including ones that
+// have been killed with KillMember.
+func (rs *ReplicaSet) Members() []*Server {
+	return rs.members
+}
+
+// URI returns a mongodb:// URI listing every member of the replica set
+func (rs *ReplicaSet) URI() string {
+	return rs.buildURI("")
+}
+
+// URIWithRandomDB returns a mongodb:// URI listing every member of the
+// replica set, with a random database name
+func (rs *ReplicaSet) URIWithRandomDB() string {
+	return rs.buildURI(RandomDatabase())
+}
+
+func (rs *ReplicaSet) buildURI(db string) string {
+	return fmt.Sprintf("mongodb://%s/%s?replicaSet=%s", rs.hosts(), db, rs.name)
+}
+
+// hosts returns a comma-separated list of the members' host:port pairs
+func (rs *ReplicaSet) hosts() string {
+	hosts := make([]string, len(rs.members))
+	for i, member := range rs.members {
+		hosts[i] = member.host()
+	}
+
+	return strings.Join(hosts, ",")
+}
+
+// Primary returns the current primary. If there is no primary (for example,
+// because an election is in progress), it waits up to 30 seconds for one to
+// be elected.
+func (rs *ReplicaSet) Primary() (*Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), electionWaitTimeout)
+	defer cancel()
+
+	return waitForPrimary(ctx, rs.runningMembers())
+}
+
+// Secondaries returns the running members that currently report themselves
+// as secondaries.
+func (rs *ReplicaSet) Secondaries() ([]*Server, error) {
+	var secondaries []*Server
+	for _, member := range rs.runningMembers() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		isMaster, err := member.isMaster(ctx)
+		cancel()
+
+		if err != nil {
+			return nil, fmt.Errorf("error checking the state of member on port %d: %s", member.Port(), err)
+		}
+
+		if isMaster.Secondary {
+			secondaries = append(secondaries, member)
+		}
+	}
+
+	return secondaries, nil
+}
+
+// StepDown asks the current primary to step down, and waits for a different
+// member to be elected primary. The old primary is not eligible for
+// re-election for 60 seconds.
+func (rs *ReplicaSet) StepDown() error {
+	oldPrimary, err := rs.Primary()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), electionWaitTimeout)
+	defer cancel()
+
+	err = oldPrimary.runAdminCommand(ctx, bson.D{
+		{Key: "replSetStepDown", Value: 60},
+		{Key: "secondaryCatchUpPeriodSecs", Value: 10},
+	}, nil)
+	if err != nil {
+		// Before MongoDB 4.2, stepping down closes all connections, so the
+		// command can fail even though the step down succeeded.
+		isMaster, isMasterErr := oldPrimary.isMaster(ctx)
+		if isMasterErr != nil || isMaster.IsMaster {
+			return fmt.Errorf("error stepping down primary on port %d: %s", oldPrimary.port, err)
+		}
+	}
+
+	var others []*Server
+	for _, member := range rs.runningMembers() {
+		if member != oldPrimary {
+			others = append(others, member)
+		}
+	}
+
+	_, err = waitForPrimary(ctx, others)
+	return err
+}
+
+// KillMember kills the i'th member of the replica set (as ordered by
+// Members()) with SIGKILL. Its data directory is kept, so it can be brought
+// back with RestartMember.
+func (rs *ReplicaSet) KillMember(i int) error {
+	member, err := rs.member(i)
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	member.restartMu.Lock()
+	defer member.restartMu.Unlock()
+
+	return member.kill()
+}
+
+// RestartMember starts the i'th member of the replica set (as ordered by
+// Members()) again, on the same port and with the same data directory. If
+// the member is still running, it's killed first.
+func (rs *ReplicaSet) RestartMember(i int) error {
+	member, err := rs.member(i)
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	member.restartMu.Lock()
+	defer member.restartMu.Unlock()
+
+	err = member.kill()
+	if err != nil {
+		return err
+	}
+
+	return member.launch(context.Background())
+}
+
+// Stop shuts down every member of the replica set and removes their data
+// directories. Errors are logged rather than returned; use StopContext to
+// handle them.
+func (rs *ReplicaSet) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStopTimeout)
+	defer cancel()
+
+	err := rs.StopContext(ctx)
+	if err != nil {
+		rs.logger.Warnf("error stopping replica set %s: %s", rs.name, err)
+	}
+}
+
+// StopContext shuts down every member of the replica set, like
+// Server.StopContext. The members are shut down concurrently, so a primary
+// doesn't wait for its secondaries to catch up before shutting down.
+func (rs *ReplicaSet) StopContext(ctx context.Context) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var (
+		errs multiError
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+	)
+
+	for _, member := range rs.members {
+		wg.Add(1)
+		go func(member *Server) {
+			defer wg.Done()
+
+			err := member.StopContext(ctx)
+			if err != nil {
+				mu.Lock()
+				errs.add(fmt.Errorf("member on port %d: %s", member.Port(), err))
+				mu.Unlock()
+			}
+		}(member)
+	}
+
+	wg.Wait()
+
+	return errs.errOrNil()
+}
+
+func (rs *ReplicaSet) member(i int) (*Server, error) {
+	if i < 0 || i >= len(rs.members) {
+		return nil, fmt.Errorf("replica set %s has no member %d", rs.name, i)
+	}
+
+	return rs.members[i], nil
+}
+
+func (rs *ReplicaSet) runningMembers() []*Server {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var running []*Server
+	for _, member := range rs.members {
+		if member.process() != nil {
+			running = append(running, member)
+		}
+	}
+
+	return running
+}
+
+// isMasterResult is the subset of the isMaster command's response that we
+// care about
+type isMasterResult struct {
+	IsMaster  bool   `bson:"ismaster"`
+	Secondary bool   `bson:"secondary"`
+	SetName   string `bson:"setName"`
+}
+
+// initiateReplicaSet runs replSetInitiate against the first member, making
+// all of the given servers members of the named replica set. It then waits
+// until one of the members reports itself as primary.
+func initiateReplicaSet(ctx context.Context, name string, members []*Server) error {
+	memberDocs := make(bson.A, len(members))
+	for i, member := range members {
+		memberDocs[i] = bson.D{
+			{Key: "_id", Value: i},
+			{Key: "host", Value: member.host()},
+		}
+	}
+
+	config := bson.D{
+		{Key: "_id", Value: name},
+		{Key: "members", Value: memberDocs},
+	}
+
+	err := members[0].runAdminCommand(ctx, bson.D{{Key: "replSetInitiate", Value: config}}, nil)
+	if err != nil {
+		return fmt.Errorf("error initiating replica set %s: %s", name, err)
+	}
+
+	_, err = waitForPrimary(ctx, members)
+	return err
+}
+
+// waitForPrimary polls the given servers until one of them reports that it's
+// the primary, and returns that server.
+func waitForPrimary(ctx context.Context, members []*Server) (*Server, error) {
+	for {
+		for _, member := range members {
+			probeCtx, cancel := context.WithTimeout(ctx, time.Second)
+			isMaster, err := member.isMaster(probeCtx)
+			cancel()
+
+			if err == nil && isMaster.IsMaster {
+				return member, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for replica set to elect a primary: %s", ctx.Err())
+		case <-time.After(replicaSetPollInterval):
+		}
+	}
+}
+
+func (s *Server) isMaster(ctx context.Context) (*isMasterResult, error) {
+	var result isMasterResult
+	err := s.runAdminCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
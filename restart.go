@@ -0,0 +1,273 @@
+package memongo
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Restart modes for RestartPolicy.Mode
+const (
+	// RestartNever leaves mongod down if it crashes. This is the default.
+	RestartNever = "never"
+
+	// RestartOnFailure restarts mongod if it crashes
+	RestartOnFailure = "on-failure"
+)
+
+const (
+	defaultRestartMaxAttempts = 5
+	defaultRestartBackoff     = time.Second
+)
+
+// RestartPolicy says whether memongo restarts mongod if it crashes (for
+// example, after a laptop sleeps), and how hard it tries.
+//
+// A restarted mongod listens on the same port. With the wiredTiger storage
+// engine, it keeps its data directory, and so its data. With other engines,
+// it starts with an empty data directory; memongo initiates the replica set
+// again when Options.ReplicaSet is set, and recreates the admin user (with the
+// same credentials) when Options.Auth is set, but any other users and data
+// are gone.
+type RestartPolicy struct {
+	// RestartNever (the default) or RestartOnFailure
+	Mode string
+
+	// How many times to try restarting mongod after each crash before giving
+	// up. Defaults to 5.
+	MaxAttempts int
+
+	// How long to wait before the first attempt to restart mongod. The wait
+	// doubles after each failed attempt. Defaults to 1 second.
+	Backoff time.Duration
+}
+
+func (p *RestartPolicy) fillDefaults() error {
+	switch p.Mode {
+	case "":
+		p.Mode = RestartNever
+	case RestartNever:
+	case RestartOnFailure:
+		if p.MaxAttempts == 0 {
+			p.MaxAttempts = defaultRestartMaxAttempts
+		}
+		if p.Backoff == 0 {
+			p.Backoff = defaultRestartBackoff
+		}
+	default:
+		return fmt.Errorf("unknown restart mode %q", p.Mode)
+	}
+
+	return nil
+}
+
+// restartAfterCrash tries to restart mongod after it crashed, according to
+// Options.Restart. It's called from the goroutine that reaped the crashed
+// process. StopContext cancels it.
+func (s *Server) restartAfterCrash() {
+	policy := s.opts.Restart
+	if policy.Mode != RestartOnFailure {
+		return
+	}
+
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	// Stop may have been called (say, by OnCrash) while we were waiting for
+	// the lock
+	ctx := s.restartCtx
+	if ctx.Err() != nil {
+		return
+	}
+
+	backoff := policy.Backoff
+
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		s.logger.Infof("Restarting mongod on port %d in %s (attempt %d of %d)", s.port, backoff, attempt, policy.MaxAttempts)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		err := s.relaunch(ctx)
+		if err == nil {
+			s.logger.Infof("Restarted mongod on port %d", s.port)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.logger.Warnf("error restarting mongod: %s", err)
+		backoff *= 2
+	}
+
+	s.logger.Warnf("giving up on restarting mongod on port %d after %d attempts", s.port, policy.MaxAttempts)
+}
+
+// relaunch starts the crashed mongod again. Unless its storage engine keeps
+// data on disk, its data directory is cleared first, so it's set up again
+// with launchFresh.
+func (s *Server) relaunch(ctx context.Context) error {
+	fresh := s.opts.StorageEngine != StorageEngineWiredTiger
+	if fresh {
+		err := s.clearDBDir()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The last mongod's watcher has nothing left to watch
+	err := s.stopWatcher()
+	if err != nil {
+		return err
+	}
+
+	if !fresh {
+		err = s.launch(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = s.waitForReplicaSetPrimary(ctx)
+		if err != nil {
+			s.killAfterFailedStart()
+			return err
+		}
+
+		return nil
+	}
+
+	// The fresh mongod has no users, so we connect to it without credentials
+	// (using the localhost exception) until the admin user has been created
+	// again, starting with the readiness probe. If that fails, the
+	// credentials are put back, so URI() keeps them for the next attempt.
+	username, password := s.credentials()
+	s.setCredentials("", password)
+
+	err = s.launchFresh(ctx)
+	if err != nil {
+		s.setCredentials(username, password)
+	}
+
+	return err
+}
+
+// launchFresh launches mongod with an empty data directory, and does what
+// StartWithOptions does after starting it: it initiates the replica set when
+// Options.ReplicaSet is set, and creates the admin user again, with the same
+// password, when Options.Auth is set.
+func (s *Server) launchFresh(ctx context.Context) error {
+	err := s.launch(ctx)
+	if err != nil {
+		return err
+	}
+
+	setupCtx, cancel := context.WithTimeout(ctx, s.opts.StartupTimeout)
+	defer cancel()
+
+	err = s.initialize(setupCtx)
+	if err != nil {
+		s.killAfterFailedStart()
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) initialize(ctx context.Context) error {
+	if s.opts.ReplicaSet {
+		err := initiateReplicaSet(ctx, s.opts.ReplicaSetName, []*Server{s})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.opts.Auth {
+		return s.createAdminUser(ctx)
+	}
+
+	return nil
+}
+
+// clearDBDir removes mongod's files from the data directory, leaving the
+// files memongo generated (the config file, state file, keyfile, and TLS
+// certificates)
+func (s *Server) clearDBDir() error {
+	entries, err := ioutil.ReadDir(s.dbDir)
+	if err != nil {
+		return fmt.Errorf("error reading data directory: %s", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == configFileName || name == stateFileName || name == keyFileName || strings.HasSuffix(name, ".pem") {
+			continue
+		}
+
+		err := os.RemoveAll(path.Join(s.dbDir, name))
+		if err != nil {
+			return fmt.Errorf("error clearing data directory: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Restart cleanly shuts down mongod and starts it again on the same port
+// with the same data directory, so URI() stays the same and the data
+// survives. This is for testing that your app reconnects after a database
+// restart, and that its data is durable. It needs a storage engine that keeps
+// data on disk, like wiredTiger.
+//
+// Like StopContext, Restart kills mongod if it hasn't shut down by the time
+// ctx is done. ctx also limits how long it waits for mongod to start up
+// again, along with Options.StartupTimeout. For a server started with
+// Options.ReplicaSet, Restart also waits for mongod to become primary again.
+func (s *Server) Restart(ctx context.Context) error {
+	if s.opts.StorageEngine != StorageEngineWiredTiger {
+		return fmt.Errorf("restarting needs a storage engine that keeps data on disk, like wiredTiger, but this server uses %s", s.opts.StorageEngine)
+	}
+
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	if s.cmd == nil {
+		return ErrNotRunning
+	}
+
+	s.logger.Infof("Restarting mongod on port %d", s.port)
+
+	err := s.shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.launch(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.waitForReplicaSetPrimary(ctx)
+}
+
+// waitForReplicaSetPrimary waits for a restarted single-node replica set to
+// elect mongod as its primary again, so that it's ready for writes. It does
+// nothing for standalone servers.
+func (s *Server) waitForReplicaSetPrimary(ctx context.Context) error {
+	if s.replicaSetName == "" {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, s.opts.StartupTimeout)
+	defer cancel()
+
+	_, err := waitForPrimary(waitCtx, []*Server{s})
+	return err
+}
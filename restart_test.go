@@ -0,0 +1,157 @@
+package memongo
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/benweissmann/memongo/memongolog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClearDBDir(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dbDir)
+
+	for _, name := range []string{"mongod.lock", "storage.bson", configFileName, stateFileName, "ca.pem", "server.pem"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dbDir, name), nil, 0600))
+	}
+	require.NoError(t, os.Mkdir(path.Join(dbDir, "diagnostic.data"), 0700))
+
+	server := &Server{dbDir: dbDir}
+	require.NoError(t, server.clearDBDir())
+
+	entries, err := ioutil.ReadDir(dbDir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	// memongo's own files are kept
+	assert.Equal(t, []string{"ca.pem", stateFileName, configFileName, "server.pem"}, names)
+}
+
+func TestRestartAfterCrashGivesUp(t *testing.T) {
+	// A fake mongod that records each run, then fails
+	binPath := writeFakeMongod(t, "echo run >> \"$(dirname \"$0\")/runs\"\nexit 3\n")
+	defer os.RemoveAll(path.Dir(binPath))
+
+	opts := &Options{
+		MongodBin:    binPath,
+		MongoVersion: "4.0.13",
+		LogLevel:     memongolog.LogLevelDebug,
+		Restart:      RestartPolicy{Mode: RestartOnFailure, MaxAttempts: 2, Backoff: 10 * time.Millisecond},
+	}
+	require.NoError(t, opts.fillDefaults())
+
+	server, err := newServer(opts, binPath, 27100)
+	require.NoError(t, err)
+	defer server.removeDBDir()
+
+	server.restartAfterCrash()
+
+	runs, err := ioutil.ReadFile(path.Join(path.Dir(binPath), "runs"))
+	require.NoError(t, err)
+	assert.Equal(t, "run\nrun\n", string(runs))
+
+	// Once the server is stopped, it isn't restarted
+	require.NoError(t, server.StopContext(context.Background()))
+	require.NoError(t, os.Remove(path.Join(path.Dir(binPath), "runs")))
+
+	server.restartAfterCrash()
+
+	_, err = os.Stat(path.Join(path.Dir(binPath), "runs"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestartNeedsPersistentStorage(t *testing.T) {
+	server := &Server{opts: &Options{StorageEngine: StorageEngineEphemeralForTest}}
+	require.EqualError(t, server.Restart(context.Background()),
+		"restarting needs a storage engine that keeps data on disk, like wiredTiger, but this server uses ephemeralForTest")
+
+	server = &Server{opts: &Options{StorageEngine: StorageEngineWiredTiger}}
+	require.Equal(t, ErrNotRunning, server.Restart(context.Background()))
+}
+
+// credentialsProbe stands in for pingProbe, recording the username the
+// server would have connected to mongod with
+type credentialsProbe struct {
+	username string
+	err      error
+}
+
+func (p *credentialsProbe) state() startupState {
+	return startupProbing
+}
+
+func (p *credentialsProbe) wait(ctx context.Context, s *Server) error {
+	p.username, _ = s.credentials()
+	return p.err
+}
+
+func TestRelaunchWithoutCredentials(t *testing.T) {
+	// A fake mongod that reports it's ready on the port it's given
+	binPath := writeFakeMongod(t, `for arg; do [ "$prev" = --port ] && port=$arg; prev=$arg; done
+echo "2019-11-05T12:00:00.000+0000 I NETWORK  [initandlisten] waiting for connections on port $port"
+exec sleep 30
+`)
+	defer os.RemoveAll(path.Dir(binPath))
+
+	tests := map[string]struct {
+		probeErr error
+	}{
+		// mongod never answers
+		"not ready": {probeErr: errors.New("not answering")},
+
+		// mongod "answers", but nothing is listening, so creating the admin
+		// user fails
+		"admin user not created": {},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			opts := &Options{
+				MongodBin:      binPath,
+				MongoVersion:   "4.0.13",
+				LogLevel:       memongolog.LogLevelSilent,
+				StorageEngine:  StorageEngineEphemeralForTest,
+				Auth:           true,
+				StartupTimeout: 500 * time.Millisecond,
+			}
+			require.NoError(t, opts.fillDefaults())
+
+			port, err := opts.pickFreePort()
+			require.NoError(t, err)
+
+			server, err := newServer(opts, binPath, port)
+			require.NoError(t, err)
+			defer server.removeDBDir()
+
+			server.setCredentials(authUsername, "secret")
+
+			probe := &credentialsProbe{err: test.probeErr}
+			server.readyProbe = probe
+
+			require.Error(t, server.relaunch(context.Background()))
+
+			// The fresh mongod has no admin user, so it was probed without
+			// credentials, but they're kept for the next attempt
+			assert.Equal(t, "", probe.username)
+
+			username, password := server.credentials()
+			assert.Equal(t, authUsername, username)
+			assert.Equal(t, "secret", password)
+		})
+	}
+}
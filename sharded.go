@@ -0,0 +1,223 @@
+package memongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benweissmann/memongo/memongolog"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const configReplicaSetName = "configRS"
+
+// ShardedCluster represents a running sharded cluster: a config server
+// replica set, one or more shards (each a replica set), and a mongos router
+type ShardedCluster struct {
+	configServers *ReplicaSet
+	shards        []*ReplicaSet
+	mongos        *Server
+	logger        *memongolog.Logger
+}
+
+// StartShardedCluster starts a sharded cluster with the given number of
+// shards. The config servers and each shard are single-member replica sets.
+// Clients should connect to the mongos router, using URI().
+//
+// If opts.Port is given, mongos listens on opts.Port and the config server
+// and shards listen on the ports after it. opts.ReplicaSet and
+// opts.ReplicaSetName are ignored. opts.Auth, opts.TLS, and opts.Restart are
+// not supported.
+func StartShardedCluster(opts *Options, shards int) (*ShardedCluster, error) {
+	if shards < 1 {
+		return nil, errors.New("a sharded cluster needs at least one shard")
+	}
+	if opts.Auth {
+		return nil, errors.New("memongo does not support Auth for sharded clusters")
+	}
+	if opts.TLS {
+		return nil, errors.New("memongo does not support TLS for sharded clusters")
+	}
+
+	if opts.Restart.Mode == RestartOnFailure {
+		return nil, errors.New("memongo does not support Restart for sharded clusters")
+	}
+
+	opts.ReplicaSet = true
+
+	err := opts.fillDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := opts.getLogger()
+	sweepOnStart(opts, logger)
+
+	logger.Infof("Starting MongoDB sharded cluster with %d shards and options %#v", shards, opts)
+
+	ctx := context.Background()
+
+	mongodPath, err := opts.getOrDownloadBinPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mongosPath, err := opts.getOrDownloadMongosBinPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("Using binaries %s and %s", mongodPath, mongosPath)
+
+	err = opts.fillVersionDefaults(ctx, mongodPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := &ShardedCluster{
+		logger: logger,
+	}
+
+	// Ports are allocated as: mongos, config server, then each shard
+	portAt := func(offset int) int {
+		if opts.Port == 0 {
+			return 0
+		}
+
+		return opts.Port + offset
+	}
+
+	configOpts := *opts
+	configOpts.ReplicaSetName = configReplicaSetName
+
+	cluster.configServers, err = startReplicaSet(ctx, &configOpts, mongodPath, 1, portAt(1), []string{"--configsvr"})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < shards; i++ {
+		shardOpts := *opts
+		shardOpts.ReplicaSetName = fmt.Sprintf("shard%d", i)
+
+		shard, err := startReplicaSet(ctx, &shardOpts, mongodPath, 1, portAt(2+i), []string{"--shardsvr"})
+		if err != nil {
+			cluster.Stop()
+			return nil, err
+		}
+
+		cluster.shards = append(cluster.shards, shard)
+	}
+
+	mongosOpts := *opts
+	mongosOpts.ReplicaSet = false
+
+	cluster.mongos, err = newServer(&mongosOpts, mongosPath, portAt(0))
+	if err != nil {
+		cluster.Stop()
+		return nil, err
+	}
+	cluster.mongos.configDB = fmt.Sprintf("%s/%s", configReplicaSetName, cluster.configServers.hosts())
+
+	err = cluster.mongos.launch(ctx)
+	if err != nil {
+		_ = cluster.mongos.removeDBDir()
+		cluster.mongos = nil
+		cluster.Stop()
+		return nil, err
+	}
+
+	addShardCtx, cancel := context.WithTimeout(ctx, electionWaitTimeout)
+	defer cancel()
+
+	for _, shard := range cluster.shards {
+		err := cluster.addShard(addShardCtx, shard)
+		if err != nil {
+			cluster.Stop()
+			return nil, err
+		}
+	}
+
+	return cluster, nil
+}
+
+// addShard adds a shard to the cluster. mongos may not be able to reach the
+// config servers right away, so this retries until the context is done.
+func (c *ShardedCluster) addShard(ctx context.Context, shard *ReplicaSet) error {
+	shardStr := fmt.Sprintf("%s/%s", shard.name, shard.hosts())
+
+	for {
+		err := c.mongos.runAdminCommand(ctx, bson.D{{Key: "addShard", Value: shardStr}}, nil)
+		if err == nil {
+			c.logger.Debugf("Added shard %s", shardStr)
+			return nil
+		}
+
+		c.logger.Debugf("Error adding shard %s, retrying: %s", shardStr, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error adding shard %s: %s", shardStr, err)
+		case <-time.After(replicaSetPollInterval):
+		}
+	}
+}
+
+// URI returns a mongodb:// URI to connect to the mongos router
+func (c *ShardedCluster) URI() string {
+	return c.mongos.URI()
+}
+
+// URIWithRandomDB returns a mongodb:// URI to connect to the mongos router,
+// with a random database name
+func (c *ShardedCluster) URIWithRandomDB() string {
+	return c.mongos.URIWithRandomDB()
+}
+
+// Mongos returns the mongos router
+func (c *ShardedCluster) Mongos() *Server {
+	return c.mongos
+}
+
+// ConfigServers returns the config server replica set
+func (c *ShardedCluster) ConfigServers() *ReplicaSet {
+	return c.configServers
+}
+
+// Shards returns the replica sets making up each shard
+func (c *ShardedCluster) Shards() []*ReplicaSet {
+	return c.shards
+}
+
+// Stop shuts down every process in the cluster and removes their data
+// directories. Errors are logged rather than returned; use StopContext to
+// handle them.
+func (c *ShardedCluster) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStopTimeout)
+	defer cancel()
+
+	err := c.StopContext(ctx)
+	if err != nil {
+		c.logger.Warnf("error stopping sharded cluster: %s", err)
+	}
+}
+
+// StopContext shuts down the mongos router, then the shards, then the config
+// servers, like Server.StopContext.
+func (c *ShardedCluster) StopContext(ctx context.Context) error {
+	var errs multiError
+
+	if c.mongos != nil {
+		errs.add(c.mongos.StopContext(ctx))
+	}
+
+	for _, shard := range c.shards {
+		errs.add(shard.StopContext(ctx))
+	}
+
+	if c.configServers != nil {
+		errs.add(c.configServers.StopContext(ctx))
+	}
+
+	return errs.errOrNil()
+}
@@ -0,0 +1,75 @@
+package memongo
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The name of the Unix domain socket in the server's data directory
+const socketFileName = "mongodb.sock"
+
+// Because we pass --unixSocketPrefix, mongod also creates its usual socket,
+// mongodb-<port>.sock, next to ours. The port isn't always known when we
+// check the path, so we assume the longest port number.
+const longestPortSocketFileName = "mongodb-65535.sock"
+
+// The longest socket path we can bind to. sockaddr_un has room for 104 bytes
+// on MacOS (108 on Linux), including the terminating NUL.
+const maxSocketPathLen = 103
+
+// mongod needs a port number even when it isn't listening on TCP, so with
+// DisableTCP we give it its default port. Nothing binds to it, so it can't
+// conflict with anything.
+const disabledTCPPort = 27017
+
+// socketPath returns the path to the server's Unix domain socket, or "" if it
+// isn't listening on one
+func (s *Server) socketPath() string {
+	if !s.opts.UnixSocket {
+		return ""
+	}
+
+	return path.Join(s.dbDir, socketFileName)
+}
+
+// checkSocketPath returns an error if any socket path mongod will create is
+// too long to bind to
+func (s *Server) checkSocketPath() error {
+	if !s.opts.UnixSocket {
+		return nil
+	}
+
+	socketPath := path.Join(s.dbDir, longestPortSocketFileName)
+	if len(socketPath) > maxSocketPathLen {
+		return fmt.Errorf("the socket path %s is longer than %d characters; set TMPDIR to a shorter directory", socketPath, maxSocketPathLen)
+	}
+
+	return nil
+}
+
+// socketHost returns the socket path, percent-encoded for use as the host in
+// a URI
+func (s *Server) socketHost() string {
+	return strings.Replace(url.PathEscape(s.socketPath()), "/", "%2F", -1)
+}
+
+// SocketPath returns the path to the Unix domain socket the server listens
+// on if it was started with Options.UnixSocket, or "" otherwise.
+func (s *Server) SocketPath() string {
+	return s.socketPath()
+}
+
+// SocketURI returns a mongodb:// URI that connects over the Unix domain
+// socket (e.g. mongodb://%2Ftmp%2Fmemongo-1234%2Fmongodb.sock) if the server was
+// started with Options.UnixSocket, or "" otherwise. Like URI(), it includes
+// any credentials and options needed to connect.
+func (s *Server) SocketURI() string {
+	if !s.opts.UnixSocket {
+		return ""
+	}
+
+	username, password := s.credentials()
+	return s.buildUserURI(s.socketHost(), "", username, password, s.authSource())
+}
@@ -0,0 +1,80 @@
+package memongo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketURIs(t *testing.T) {
+	tests := map[string]struct {
+		server *Server
+
+		expectedSocketPath string
+		expectedPort       int
+		expectedURI        string
+		expectedSocketURI  string
+	}{
+		"TCP only": {
+			server:       &Server{opts: &Options{}, dbDir: "/tmp/1234", port: 27100},
+			expectedPort: 27100,
+			expectedURI:  "mongodb://localhost:27100",
+		},
+		"socket and TCP": {
+			server:             &Server{opts: &Options{UnixSocket: true}, dbDir: "/tmp/1234", port: 27100},
+			expectedSocketPath: "/tmp/1234/mongodb.sock",
+			expectedPort:       27100,
+			expectedURI:        "mongodb://localhost:27100",
+			expectedSocketURI:  "mongodb://%2Ftmp%2F1234%2Fmongodb.sock",
+		},
+		"socket only": {
+			server:             &Server{opts: &Options{UnixSocket: true, DisableTCP: true}, dbDir: "/tmp/1234", port: disabledTCPPort},
+			expectedSocketPath: "/tmp/1234/mongodb.sock",
+			expectedPort:       0,
+			expectedURI:        "mongodb://%2Ftmp%2F1234%2Fmongodb.sock",
+			expectedSocketURI:  "mongodb://%2Ftmp%2F1234%2Fmongodb.sock",
+		},
+		"special characters": {
+			server:             &Server{opts: &Options{UnixSocket: true}, dbDir: "/tmp/my dir:1", port: 27100},
+			expectedSocketPath: "/tmp/my dir:1/mongodb.sock",
+			expectedPort:       27100,
+			expectedURI:        "mongodb://localhost:27100",
+			expectedSocketURI:  "mongodb://%2Ftmp%2Fmy%20dir:1%2Fmongodb.sock",
+		},
+		"with credentials": {
+			server:             &Server{opts: &Options{UnixSocket: true, AuthMechanism: AuthMechanismSCRAMSHA1}, dbDir: "/tmp/1234", port: 27100, username: "memongo", password: "pw"},
+			expectedSocketPath: "/tmp/1234/mongodb.sock",
+			expectedPort:       27100,
+			expectedURI:        "mongodb://memongo:pw@localhost:27100/?authMechanism=SCRAM-SHA-1&authSource=admin",
+			expectedSocketURI:  "mongodb://memongo:pw@%2Ftmp%2F1234%2Fmongodb.sock/?authMechanism=SCRAM-SHA-1&authSource=admin",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expectedSocketPath, test.server.SocketPath())
+			assert.Equal(t, test.expectedPort, test.server.Port())
+			assert.Equal(t, test.expectedURI, test.server.URI())
+			assert.Equal(t, test.expectedSocketURI, test.server.SocketURI())
+		})
+	}
+}
+
+func TestCheckSocketPath(t *testing.T) {
+	server := &Server{opts: &Options{UnixSocket: true}, dbDir: "/tmp/1234"}
+	require.NoError(t, server.checkSocketPath())
+
+	server.dbDir = "/tmp/" + strings.Repeat("a", 100)
+	require.Error(t, server.checkSocketPath())
+
+	// mongodb.sock would fit, but mongod's mongodb-<port>.sock wouldn't
+	server.dbDir = "/tmp/" + strings.Repeat("a", maxSocketPathLen-len("/tmp//mongodb.sock"))
+	require.Len(t, server.socketPath(), maxSocketPathLen)
+	require.Error(t, server.checkSocketPath())
+
+	// Without a socket, the path doesn't matter
+	server.opts.UnixSocket = false
+	require.NoError(t, server.checkSocketPath())
+}
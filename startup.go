@@ -0,0 +1,167 @@
+package memongo
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// How often the ping probe retries, and how long each attempt may take
+const (
+	pingProbeInterval = 100 * time.Millisecond
+	pingProbeTimeout  = time.Second
+)
+
+// startupState is a state in the startup state machine. A launched server
+// moves from startupWaitingForPort to startupProbing to startupReady, or to
+// startupFailed from any state.
+type startupState int
+
+const (
+	// mongod has been launched, and we're waiting for it to log its port
+	startupWaitingForPort startupState = iota
+
+	// We know the port, and we're waiting for mongod to answer commands
+	startupProbing
+
+	// mongod is ready for use
+	startupReady
+
+	// mongod failed to start, timed out, or exited
+	startupFailed
+)
+
+func (state startupState) String() string {
+	switch state {
+	case startupWaitingForPort:
+		return "waiting for port"
+	case startupProbing:
+		return "probing"
+	case startupReady:
+		return "ready"
+	case startupFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown state %d", int(state))
+	}
+}
+
+// A readinessProbe checks one aspect of whether a launched server is ready.
+// wait blocks until the probe passes, the probe fails, or ctx is done.
+type readinessProbe interface {
+	// The state the server is in while this probe runs
+	state() startupState
+
+	wait(ctx context.Context, s *Server) error
+}
+
+// listenInfo is where mongod reported it's listening, once it's ready
+type listenInfo struct {
+	port int
+
+	// The IP addresses (but not sockets) mongod logged that it's listening
+	// on, if any. Older versions don't log these.
+	addresses []string
+}
+
+// logPortProbe waits for mongod to log the port it's listening on (or a
+// startup error), as reported by stdoutHandler.
+type logPortProbe struct {
+	readyCh <-chan listenInfo
+	errCh   <-chan error
+}
+
+func (p *logPortProbe) state() startupState {
+	return startupWaitingForPort
+}
+
+func (p *logPortProbe) wait(ctx context.Context, s *Server) error {
+	select {
+	case info := <-p.readyCh:
+		s.setAddress(connectableHost(info.addresses), info.port)
+		return nil
+	case err := <-p.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pingProbe repeatedly runs isMaster against the server until it answers.
+// mongod can log that it's waiting for connections slightly before it's
+// actually able to run commands.
+type pingProbe struct{}
+
+func (p *pingProbe) state() startupState {
+	return startupProbing
+}
+
+func (p *pingProbe) wait(ctx context.Context, s *Server) error {
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, pingProbeTimeout)
+		_, err := s.isMaster(attemptCtx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		s.logger.Debugf("mongod is not answering commands yet: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pingProbeInterval):
+		}
+	}
+}
+
+// waitForStartup runs each probe in order until the server is ready. It
+// fails if any probe fails, if mongod exits, or if ctx is done first.
+func (s *Server) waitForStartup(ctx context.Context, probes []readinessProbe) error {
+	startupTime := time.Now()
+
+	// Cancel the probes as soon as mongod exits
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func(exited <-chan struct{}) {
+		select {
+		case <-exited:
+			cancel()
+		case <-probeCtx.Done():
+		}
+	}(s.exited)
+
+	for _, probe := range probes {
+		s.logger.Debugf("mongod startup: %s", probe.state())
+
+		err := probe.wait(probeCtx, s)
+		if err != nil {
+			s.logger.Debugf("mongod startup: %s after %s", startupFailed, time.Since(startupTime).String())
+			return s.startupError(ctx, err)
+		}
+	}
+
+	s.logger.Debugf("mongod startup: %s after %s", startupReady, time.Since(startupTime).String())
+
+	return nil
+}
+
+// startupError works out why startup failed. A probe that was cancelled
+// reports a context error, which we translate into something more useful.
+func (s *Server) startupError(ctx context.Context, probeErr error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &StartupError{Err: ErrStartupTimeout}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if s.hasExited() && (probeErr == context.Canceled || probeErr == context.DeadlineExceeded) {
+		return &StartupError{Err: ErrExitedEarly}
+	}
+
+	return probeErr
+}
@@ -0,0 +1,102 @@
+package memongo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benweissmann/memongo/memongolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// funcProbe is a readinessProbe backed by a function
+type funcProbe func(ctx context.Context, s *Server) error
+
+func (p funcProbe) state() startupState {
+	return startupProbing
+}
+
+func (p funcProbe) wait(ctx context.Context, s *Server) error {
+	return p(ctx, s)
+}
+
+// blockingProbe blocks until its context is done
+var blockingProbe = funcProbe(func(ctx context.Context, s *Server) error {
+	<-ctx.Done()
+	return ctx.Err()
+})
+
+func newTestServer() *Server {
+	return &Server{
+		logger: memongolog.New(nil, memongolog.LogLevelSilent),
+		exited: make(chan struct{}),
+	}
+}
+
+func TestWaitForStartup(t *testing.T) {
+	s := newTestServer()
+
+	readyCh := make(chan listenInfo, 1)
+	readyCh <- listenInfo{port: 12345, addresses: []string{"::1"}}
+
+	var ran []string
+	err := s.waitForStartup(context.Background(), []readinessProbe{
+		&logPortProbe{readyCh: readyCh},
+		funcProbe(func(ctx context.Context, s *Server) error {
+			ran = append(ran, "first")
+			return nil
+		}),
+		funcProbe(func(ctx context.Context, s *Server) error {
+			ran = append(ran, "second")
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 12345, s.port)
+	assert.Equal(t, "::1", s.boundHost)
+	assert.Equal(t, []string{"first", "second"}, ran)
+}
+
+func TestWaitForStartupProbeError(t *testing.T) {
+	s := newTestServer()
+
+	errCh := make(chan error, 1)
+	errCh <- errors.New("Mongod startup failed, address in use")
+
+	ranSecond := false
+	err := s.waitForStartup(context.Background(), []readinessProbe{
+		&logPortProbe{errCh: errCh},
+		funcProbe(func(ctx context.Context, s *Server) error {
+			ranSecond = true
+			return nil
+		}),
+	})
+	require.EqualError(t, err, "Mongod startup failed, address in use")
+	assert.False(t, ranSecond)
+}
+
+func TestWaitForStartupTimeout(t *testing.T) {
+	s := newTestServer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := s.waitForStartup(ctx, []readinessProbe{blockingProbe})
+	require.True(t, errors.Is(err, ErrStartupTimeout))
+}
+
+func TestWaitForStartupExited(t *testing.T) {
+	s := newTestServer()
+	s.exitErr = errors.New("exit status 100")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(s.exited)
+	}()
+
+	err := s.waitForStartup(context.Background(), []readinessProbe{blockingProbe})
+	require.True(t, errors.Is(err, ErrExitedEarly))
+}
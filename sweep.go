@@ -0,0 +1,221 @@
+package memongo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/benweissmann/memongo/memongolog"
+	"github.com/benweissmann/memongo/monitor"
+)
+
+// Data directories are named with this prefix, so Sweep can find them
+const dbDirPrefix = "memongo-"
+
+// The name of the state file in each data directory
+const stateFileName = "memongo.json"
+
+// Sweep removes data directories without a state file once they're this old.
+// Newer ones may belong to a server that's still starting.
+const staleDirAge = time.Hour
+
+// How long Sweep waits for a leftover mongod to exit after killing it
+const sweepKillTimeout = 5 * time.Second
+
+// serverState is written to the state file in each data directory, so Sweep
+// can tell whether the directory's owner is still around. Processes are
+// identified by pid and start time (see monitor.ProcessIdentity), so that a
+// later process that reuses a pid isn't mistaken for them.
+type serverState struct {
+	// mongod's pid, start time, and port
+	PID       int    `json:"pid"`
+	StartTime string `json:"startTime"`
+	Port      int    `json:"port"`
+
+	// The pid and start time of the process that started mongod
+	ParentPID       int    `json:"parentPid"`
+	ParentStartTime string `json:"parentStartTime"`
+}
+
+// writeState writes the state file for the current mongod process
+func (s *Server) writeState() error {
+	pid := s.cmd.Process.Pid
+	startTime, err := monitor.ProcessIdentity(pid)
+	if err != nil {
+		return err
+	}
+
+	parentStartTime, err := monitor.ProcessIdentity(os.Getpid())
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(serverState{
+		PID:             pid,
+		StartTime:       startTime,
+		Port:            s.port,
+		ParentPID:       os.Getpid(),
+		ParentStartTime: parentStartTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(s.dbDir, stateFileName), contents, 0600)
+}
+
+// writeStateOrWarn writes the state file, logging rather than returning any
+// error, since the server works fine without one
+func (s *Server) writeStateOrWarn() {
+	err := s.writeState()
+	if err != nil {
+		s.logger.Warnf("error writing state file: %s", err)
+	}
+}
+
+// Sweep cleans up after test processes that exited without stopping their
+// servers (for example, because they were killed with SIGKILL along with
+// their watchers). It finds memongo data directories whose owning process is
+// gone, kills any mongod still running in them, and removes them. It returns
+// the directories it removed.
+//
+// It's safe to call while other processes are using memongo: it leaves their
+// directories alone.
+func Sweep() ([]string, error) {
+	var swept []string
+	var errs multiError
+
+	for _, root := range sweepRoots() {
+		rootSwept, err := sweepRoot(root)
+		swept = append(swept, rootSwept...)
+		errs.add(err)
+	}
+
+	return swept, errs.errOrNil()
+}
+
+// sweepRoots returns the directories data directories are created in
+func sweepRoots() []string {
+	roots := []string{os.TempDir()}
+
+	stat, err := os.Stat(ramDiskPath)
+	if err == nil && stat.IsDir() && path.Clean(ramDiskPath) != path.Clean(os.TempDir()) {
+		roots = append(roots, ramDiskPath)
+	}
+
+	return roots
+}
+
+// sweepRoot sweeps the data directories in root
+func sweepRoot(root string) ([]string, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", root, err)
+	}
+
+	var swept []string
+	var errs multiError
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), dbDirPrefix) {
+			continue
+		}
+
+		dir := path.Join(root, entry.Name())
+
+		stale, err := sweepDir(dir, entry.ModTime())
+		if err != nil {
+			errs.add(fmt.Errorf("error sweeping %s: %s", dir, err))
+		}
+		if stale && err == nil {
+			swept = append(swept, dir)
+		}
+	}
+
+	return swept, errs.errOrNil()
+}
+
+// sweepDir removes dir if its owner is gone, after killing its mongod if
+// that's still running. It returns true if the directory was stale.
+func sweepDir(dir string, modTime time.Time) (bool, error) {
+	contents, err := ioutil.ReadFile(path.Join(dir, stateFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	var state serverState
+	if err == nil {
+		err = json.Unmarshal(contents, &state)
+	}
+
+	if err != nil || state.ParentStartTime == "" {
+		// There's no usable state file. The server may still be starting up,
+		// or its owner may have died before it started.
+		if time.Since(modTime) < staleDirAge {
+			return false, nil
+		}
+
+		return true, os.RemoveAll(dir)
+	}
+
+	if isProcess(state.ParentPID, state.ParentStartTime) {
+		return false, nil
+	}
+
+	if state.StartTime != "" && isProcess(state.PID, state.StartTime) {
+		err := killAndWait(state.PID, state.StartTime)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, os.RemoveAll(dir)
+}
+
+// isProcess returns true if pid is a running process with the given start
+// time
+func isProcess(pid int, startTime string) bool {
+	identity, err := monitor.ProcessIdentity(pid)
+	return err == nil && identity == startTime
+}
+
+// killAndWait kills pid with SIGKILL, and waits for it to exit
+func killAndWait(pid int, startTime string) error {
+	err := syscall.Kill(pid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("error killing mongod: %s", err)
+	}
+
+	deadline := time.Now().Add(sweepKillTimeout)
+	for isProcess(pid, startTime) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("mongod (pid %d) did not exit after being killed", pid)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// sweepOnStart runs Sweep if Options.Sweep is set, logging what it cleaned
+// up. Errors are logged rather than returned, since they shouldn't stop the
+// server from starting.
+func sweepOnStart(opts *Options, logger *memongolog.Logger) {
+	if !opts.Sweep {
+		return
+	}
+
+	swept, err := Sweep()
+	for _, dir := range swept {
+		logger.Infof("Cleaned up leftover data directory %s", dir)
+	}
+	if err != nil {
+		logger.Warnf("error cleaning up leftover data directories: %s", err)
+	}
+}
@@ -0,0 +1,112 @@
+package memongo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/benweissmann/memongo/monitor"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadPID returns the pid of a process that has exited
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+
+	return cmd.Process.Pid
+}
+
+// makeServerDir creates a data directory in root with the given state (or no
+// state file, if state is nil)
+func makeServerDir(t *testing.T, root string, name string, state *serverState) string {
+	dir := path.Join(root, name)
+	require.NoError(t, os.Mkdir(dir, 0700))
+
+	if state != nil {
+		contents, err := json.Marshal(state)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, stateFileName), contents, 0600))
+	}
+
+	return dir
+}
+
+// startTime returns the start time of the process with the given pid, as
+// recorded in state files
+func startTime(t *testing.T, pid int) string {
+	identity, err := monitor.ProcessIdentity(pid)
+	require.NoError(t, err)
+
+	return identity
+}
+
+func TestSweepRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// A leftover "mongod" whose owner is dead. Like mongos, its command line
+	// doesn't mention its data directory.
+	orphan := exec.Command("sleep", "30")
+	require.NoError(t, orphan.Start())
+	defer orphan.Process.Kill()
+
+	// A real orphan would be reaped by init once it's killed
+	orphanExited := make(chan error, 1)
+	go func() {
+		orphanExited <- orphan.Wait()
+	}()
+
+	// An unrelated process that has reused a dead mongod's pid
+	unrelated := exec.Command("sleep", "30")
+	require.NoError(t, unrelated.Start())
+	defer unrelated.Process.Kill()
+
+	// A start time that doesn't match any running process
+	const staleStartTime = "1"
+
+	// We own this one, so it's left alone
+	owned := &serverState{PID: deadPID(t), StartTime: staleStartTime, ParentPID: os.Getpid(), ParentStartTime: startTime(t, os.Getpid())}
+
+	// Dead owners, including one whose pid has been reused by this process
+	dead := func(pid int, start string) *serverState {
+		return &serverState{PID: pid, StartTime: start, ParentPID: deadPID(t), ParentStartTime: staleStartTime}
+	}
+	reusedOwner := &serverState{PID: deadPID(t), StartTime: staleStartTime, ParentPID: os.Getpid(), ParentStartTime: staleStartTime}
+
+	orphanDir := makeServerDir(t, root, dbDirPrefix+"orphan", dead(orphan.Process.Pid, startTime(t, orphan.Process.Pid)))
+	reusedDir := makeServerDir(t, root, dbDirPrefix+"reused", dead(unrelated.Process.Pid, staleStartTime))
+	exitedDir := makeServerDir(t, root, dbDirPrefix+"exited", dead(deadPID(t), staleStartTime))
+	reusedOwnerDir := makeServerDir(t, root, dbDirPrefix+"reused-owner", reusedOwner)
+	ownedDir := makeServerDir(t, root, dbDirPrefix+"owned", owned)
+	startingDir := makeServerDir(t, root, dbDirPrefix+"starting", nil)
+	abandonedDir := makeServerDir(t, root, dbDirPrefix+"abandoned", nil)
+	otherDir := makeServerDir(t, root, "other", dead(deadPID(t), staleStartTime))
+
+	old := time.Now().Add(-2 * staleDirAge)
+	require.NoError(t, os.Chtimes(abandonedDir, old, old))
+
+	swept, err := sweepRoot(root)
+	require.NoError(t, err)
+
+	sort.Strings(swept)
+	assert.Equal(t, []string{abandonedDir, exitedDir, orphanDir, reusedDir, reusedOwnerDir}, swept)
+
+	for _, dir := range []string{ownedDir, startingDir, otherDir} {
+		_, err := os.Stat(dir)
+		assert.NoError(t, err, "%s should not have been swept", dir)
+	}
+
+	// The orphaned mongod was killed, but the unrelated process wasn't
+	assert.EqualError(t, <-orphanExited, "signal: killed")
+	assert.NoError(t, unrelated.Process.Signal(syscall.Signal(0)))
+}
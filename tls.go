@@ -0,0 +1,301 @@
+package memongo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"time"
+)
+
+// How long the generated certificates are valid for. They're thrown away
+// when the server stops, so this only needs to outlast a test run.
+const tlsCertificateLifetime = 24 * time.Hour
+
+// The subjects of the generated certificates. The server and clients have
+// different OUs, so mongod doesn't mistake clients for cluster members.
+var (
+	tlsCASubject     = pkix.Name{CommonName: "memongo CA", Organization: []string{"memongo"}}
+	tlsServerSubject = pkix.Name{CommonName: "localhost", Organization: []string{"memongo"}, OrganizationalUnit: []string{"server"}}
+	tlsClientSubject = pkix.Name{CommonName: "memongo", Organization: []string{"memongo"}, OrganizationalUnit: []string{"client"}}
+)
+
+// tlsFiles holds the throwaway CA and certificates for a server started with
+// Options.TLS
+type tlsFiles struct {
+	// The directory the files are written to
+	dir string
+
+	// The CA, which we keep so we can issue more client certificates
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	// Paths to the PEM-encoded CA certificate, and the server's certificate
+	// and key, which are passed to mongod
+	caFile      string
+	certKeyFile string
+
+	// The client certificate, if one was generated
+	clientCert *ClientCertificate
+
+	// A client config that trusts the CA and, if one was generated, presents
+	// the client certificate
+	config *tls.Config
+}
+
+// ClientCertificate is a client certificate signed by a server's generated
+// CA
+type ClientCertificate struct {
+	// The certificate's subject, in the RFC 2253 form that mongod uses as the
+	// username for x509 authentication (e.g. "CN=myapp,OU=services,O=acme")
+	Subject string
+
+	// The path to a PEM file containing the certificate and its key, for
+	// tools like the mongo shell
+	CertificateKeyFile string
+
+	// The certificate and key, for use in a tls.Config
+	Certificate tls.Certificate
+}
+
+// generateTLSFiles generates a CA and a server certificate for localhost
+// (and, if clientCert is true, a client certificate) and writes them into
+// dir.
+func generateTLSFiles(dir string, clientCert bool) (*tlsFiles, error) {
+	caKey, caCert, err := generateCertificate(tlsCASubject, nil, nil, func(template *x509.Certificate) {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating CA certificate: %s", err)
+	}
+
+	serverKey, serverCert, err := generateCertificate(tlsServerSubject, caKey, caCert, func(template *x509.Certificate) {
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating server certificate: %s", err)
+	}
+
+	files := &tlsFiles{
+		dir:         dir,
+		caKey:       caKey,
+		caCert:      caCert,
+		caFile:      path.Join(dir, "ca.pem"),
+		certKeyFile: path.Join(dir, "server.pem"),
+	}
+
+	err = ioutil.WriteFile(files.caFile, encodeCertificate(caCert), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error writing CA certificate: %s", err)
+	}
+
+	err = writeCertificateKeyFile(files.certKeyFile, serverKey, serverCert)
+	if err != nil {
+		return nil, fmt.Errorf("error writing server certificate: %s", err)
+	}
+
+	files.config = files.clientConfig(nil)
+
+	if clientCert {
+		files.clientCert, err = files.issueClientCertificate(tlsClientSubject)
+		if err != nil {
+			return nil, err
+		}
+
+		files.config = files.clientConfig(files.clientCert)
+	}
+
+	return files, nil
+}
+
+// issueClientCertificate generates a client certificate with the given
+// subject, signed by the CA, and writes it into the directory
+func (f *tlsFiles) issueClientCertificate(subject pkix.Name) (*ClientCertificate, error) {
+	key, cert, err := generateCertificate(subject, f.caKey, f.caCert, func(template *x509.Certificate) {
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating client certificate: %s", err)
+	}
+
+	// The serial number is random, so it makes a unique file name
+	certKeyFile := path.Join(f.dir, fmt.Sprintf("client-%x.pem", cert.SerialNumber))
+
+	err = writeCertificateKeyFile(certKeyFile, key, cert)
+	if err != nil {
+		return nil, fmt.Errorf("error writing client certificate: %s", err)
+	}
+
+	return &ClientCertificate{
+		Subject:            cert.Subject.String(),
+		CertificateKeyFile: certKeyFile,
+		Certificate: tls.Certificate{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  key,
+			Leaf:        cert,
+		},
+	}, nil
+}
+
+// clientConfig returns a TLS config that trusts the CA and presents the
+// given client certificate (if it isn't nil)
+func (f *tlsFiles) clientConfig(clientCert *ClientCertificate) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(f.caCert)
+
+	config := &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{clientCert.Certificate}
+	}
+
+	return config
+}
+
+// generateCertificate generates a key and a certificate with the given
+// subject, signed by the given parent (or self-signed if parent is nil).
+// configure fills in the rest of the certificate template.
+func generateCertificate(subject pkix.Name, parentKey *ecdsa.PrivateKey, parent *x509.Certificate, configure func(*x509.Certificate)) (*ecdsa.PrivateKey, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      subject,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(tlsCertificateLifetime),
+	}
+	configure(template)
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, cert, nil
+}
+
+func encodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// writeCertificateKeyFile writes a certificate and its key to a single PEM
+// file, which is the format mongod expects
+func writeCertificateKeyFile(filename string, key *ecdsa.PrivateKey, cert *x509.Certificate) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	contents := append(encodeCertificate(cert), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+
+	return ioutil.WriteFile(filename, contents, 0600)
+}
+
+// tlsArgs returns the mongod arguments to require TLS. MongoDB 4.2 renamed
+// the --ssl* options to --tls*; older versions only understand --ssl*, and
+// newer ones still accept it.
+func (s *Server) tlsArgs() []string {
+	mode, certKeyFile, caFile, allowNoCert := "--sslMode", "--sslPEMKeyFile", "--sslCAFile", "--sslAllowConnectionsWithoutCertificates"
+	modeValue := "requireSSL"
+
+	if s.opts.MongoVersion != "" && mongoVersionAtLeast(s.opts.MongoVersion, 4, 2) {
+		mode, certKeyFile, caFile, allowNoCert = "--tlsMode", "--tlsCertificateKeyFile", "--tlsCAFile", "--tlsAllowConnectionsWithoutCertificates"
+		modeValue = "requireTLS"
+	}
+
+	args := []string{mode, modeValue, certKeyFile, s.tls.certKeyFile, caFile, s.tls.caFile}
+
+	// Only require clients to present a certificate if we made one
+	if s.tls.clientCert == nil {
+		args = append(args, allowNoCert)
+	}
+
+	return args
+}
+
+// TLSConfig returns a TLS config for connecting to the server if it was
+// started with Options.TLS, or nil otherwise. It trusts the server's
+// generated CA, and presents the generated client certificate if there is
+// one.
+func (s *Server) TLSConfig() *tls.Config {
+	if s.tls == nil {
+		return nil
+	}
+
+	return s.tls.config.Clone()
+}
+
+// TLSCAFile returns the path to the generated CA certificate if the server
+// was started with Options.TLS, or "" otherwise. This is useful for tools
+// like the mongo shell that need the CA as a file.
+func (s *Server) TLSCAFile() string {
+	if s.tls == nil {
+		return ""
+	}
+
+	return s.tls.caFile
+}
+
+// IssueClientCertificate generates a new client certificate with the given
+// subject, signed by the server's generated CA. The server must have been
+// started with Options.TLS.
+//
+// Issuing a second certificate with the same subject is a handy way to test
+// certificate rotation: both certificates authenticate as the same x509
+// user.
+func (s *Server) IssueClientCertificate(subject pkix.Name) (*ClientCertificate, error) {
+	if s.tls == nil {
+		return nil, errors.New("the server was not started with TLS")
+	}
+
+	return s.tls.issueClientCertificate(subject)
+}
+
+// ClientTLSConfig returns a TLS config for connecting to the server that
+// trusts the server's generated CA and presents the given client
+// certificate.
+func (s *Server) ClientTLSConfig(cert *ClientCertificate) *tls.Config {
+	if s.tls == nil {
+		return nil
+	}
+
+	return s.tls.clientConfig(cert)
+}
@@ -0,0 +1,149 @@
+package memongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handshake runs a TLS handshake between a server using the given
+// certificate and key file, and a client using clientConfig
+func handshake(t *testing.T, certKeyFile string, caFile string, requireClientCert bool, clientConfig *tls.Config) error {
+	cert, err := tls.LoadX509KeyPair(certKeyFile, certKeyFile)
+	require.NoError(t, err)
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if requireClientCert {
+		caPEM, err := ioutil.ReadFile(caFile)
+		require.NoError(t, err)
+
+		serverConfig.ClientCAs = x509.NewCertPool()
+		require.True(t, serverConfig.ClientCAs.AppendCertsFromPEM(caPEM))
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	l, err := tls.Listen("tcp", "localhost:0", serverConfig)
+	require.NoError(t, err)
+	defer l.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return <-serverErr
+}
+
+func TestGenerateTLSFiles(t *testing.T) {
+	for _, clientCert := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		files, err := generateTLSFiles(dir, clientCert)
+		require.NoError(t, err)
+
+		if clientCert {
+			assert.FileExists(t, files.clientCert.CertificateKeyFile)
+			assert.Len(t, files.config.Certificates, 1)
+		} else {
+			assert.Nil(t, files.clientCert)
+			assert.Empty(t, files.config.Certificates)
+		}
+
+		// The client config trusts the server's certificate, and the server
+		// accepts the client's certificate
+		require.NoError(t, handshake(t, files.certKeyFile, files.caFile, clientCert, files.config))
+	}
+}
+
+func TestGenerateTLSFilesUntrusted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files, err := generateTLSFiles(dir, false)
+	require.NoError(t, err)
+
+	// A client that doesn't trust the generated CA can't connect
+	require.Error(t, handshake(t, files.certKeyFile, files.caFile, false, &tls.Config{ServerName: "localhost"}))
+}
+
+func TestTLSArgs(t *testing.T) {
+	files := &tlsFiles{caFile: "/db/ca.pem", certKeyFile: "/db/server.pem"}
+
+	server := &Server{opts: &Options{MongoVersion: "4.0.13"}, tls: files}
+	assert.Equal(t, []string{
+		"--sslMode", "requireSSL",
+		"--sslPEMKeyFile", "/db/server.pem",
+		"--sslCAFile", "/db/ca.pem",
+		"--sslAllowConnectionsWithoutCertificates",
+	}, server.tlsArgs())
+
+	server = &Server{opts: &Options{MongoVersion: "4.2.1"}, tls: files}
+	assert.Equal(t, []string{
+		"--tlsMode", "requireTLS",
+		"--tlsCertificateKeyFile", "/db/server.pem",
+		"--tlsCAFile", "/db/ca.pem",
+		"--tlsAllowConnectionsWithoutCertificates",
+	}, server.tlsArgs())
+
+	files.clientCert = &ClientCertificate{}
+	assert.Equal(t, []string{
+		"--tlsMode", "requireTLS",
+		"--tlsCertificateKeyFile", "/db/server.pem",
+		"--tlsCAFile", "/db/ca.pem",
+	}, server.tlsArgs())
+}
+
+func TestIssueClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &Server{opts: &Options{}}
+
+	_, err = server.IssueClientCertificate(pkix.Name{CommonName: "myapp"})
+	require.EqualError(t, err, "the server was not started with TLS")
+
+	server.tls, err = generateTLSFiles(dir, false)
+	require.NoError(t, err)
+
+	cert, err := server.IssueClientCertificate(pkix.Name{CommonName: "myapp", OrganizationalUnit: []string{"services"}, Organization: []string{"acme"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, "CN=myapp,OU=services,O=acme", cert.Subject)
+	assert.FileExists(t, cert.CertificateKeyFile)
+
+	// The certificate is signed by the server's CA
+	_, err = cert.Certificate.Leaf.Verify(x509.VerifyOptions{
+		Roots:     server.TLSConfig().RootCAs,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	require.NoError(t, err)
+
+	// Each certificate gets its own file
+	rotated, err := server.IssueClientCertificate(pkix.Name{CommonName: "myapp", OrganizationalUnit: []string{"services"}, Organization: []string{"acme"}})
+	require.NoError(t, err)
+	assert.Equal(t, cert.Subject, rotated.Subject)
+	assert.NotEqual(t, cert.CertificateKeyFile, rotated.CertificateKeyFile)
+}